@@ -0,0 +1,35 @@
+package api
+
+import (
+	"log"
+	"net/http"
+
+	ent "github.com/supriyo-biswas/postbox/entities"
+)
+
+// listAccounts lists the accounts that can be accessed with the request's
+// account token, which is only its own account.
+func (s *Server) listAccounts(w http.ResponseWriter, r *http.Request) {
+	account := r.Context().Value(accountContextKey).(*ent.Account)
+	sendResponse(w, http.StatusOK, []Account{*buildAccountResponse(account)})
+}
+
+func (s *Server) listAccountInboxes(w http.ResponseWriter, r *http.Request) {
+	account := r.Context().Value(accountContextKey).(*ent.Account)
+
+	var inboxes []ent.Inbox
+	if err := s.db.Where("account_id = ?", account.Id).Order("id").Find(&inboxes).Error; err != nil {
+		log.Printf("failed to get inboxes for account %d: %s", account.Id, err)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	result, err := s.buildInboxListResponse(inboxes)
+	if err != nil {
+		log.Printf("failed to get inboxes: %s", err)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	sendResponse(w, http.StatusOK, result)
+}
@@ -0,0 +1,217 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	ent "github.com/supriyo-biswas/postbox/entities"
+	"github.com/supriyo-biswas/postbox/utils"
+)
+
+// newInboxCredentials generates the SMTP password and API key of an inbox,
+// and stores their hashes in it.
+func newInboxCredentials(inbox *ent.Inbox) (string, string, error) {
+	smtpPass, err := utils.RandomString(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	apiKey, err := utils.RandomString(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	inbox.SmtpPass = utils.HashSecret(smtpPass)
+	inbox.ApiKey = utils.HashSecret(apiKey)
+	return smtpPass, apiKey, nil
+}
+
+func (s *Server) sendInboxCredentials(w http.ResponseWriter, status int, inbox *ent.Inbox, smtpPass, apiKey string) {
+	result, err := s.buildInboxResponse(inbox)
+	if err != nil {
+		log.Printf("failed to get inbox %d: %s", inbox.Id, err)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	sendResponse(w, status, InboxCredentials{
+		Inbox:        *result,
+		SmtpUsername: inbox.Name,
+		SmtpPassword: smtpPass,
+		ApiKey:       apiKey,
+	})
+}
+
+// inboxNameTaken reports whether an inbox other than the given one has a
+// name.
+func (s *Server) inboxNameTaken(name string, exceptId int64) (bool, error) {
+	var count int64
+	tx := s.db.Model(&ent.Inbox{}).Where("name = ? AND id != ?", name, exceptId).Count(&count)
+	return count > 0, tx.Error
+}
+
+func (s *Server) adminListInboxes(w http.ResponseWriter, r *http.Request) {
+	var inboxes []ent.Inbox
+	if err := s.db.Order("id").Find(&inboxes).Error; err != nil {
+		log.Printf("failed to get inboxes: %s", err)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	result, err := s.buildInboxListResponse(inboxes)
+	if err != nil {
+		log.Printf("failed to get inboxes: %s", err)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	sendResponse(w, http.StatusOK, result)
+}
+
+func (s *Server) adminCreateInbox(w http.ResponseWriter, r *http.Request) {
+	var req CreateInbox
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, http.StatusBadRequest, invalidRequestMsg)
+		return
+	}
+
+	var expiresAt *time.Time
+	if req.TTL != nil {
+		if *req.TTL <= 0 {
+			sendError(w, http.StatusBadRequest, invalidTtlMsg)
+			return
+		}
+
+		t := time.Now().Add(time.Duration(*req.TTL) * time.Second)
+		expiresAt = &t
+	}
+
+	// temporary inboxes get a random name if they don't have one
+	name := strings.TrimSpace(req.Name)
+	if name == "" && expiresAt != nil {
+		var err error
+		if name, err = utils.RandomName(ent.TemporaryInboxPrefix, 12); err != nil {
+			log.Printf("failed to generate inbox name: %s", err)
+			sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+			return
+		}
+	}
+
+	if name == "" {
+		sendError(w, http.StatusBadRequest, inboxNameMissingMsg)
+		return
+	}
+
+	if taken, err := s.inboxNameTaken(name, 0); err != nil {
+		log.Printf("failed to get inbox: %s", err)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	} else if taken {
+		sendError(w, http.StatusConflict, inboxExistsMsg)
+		return
+	}
+
+	if req.AccountId != nil {
+		var count int64
+		tx := s.db.Model(&ent.Account{}).Where("id = ?", *req.AccountId).Count(&count)
+		if tx.Error != nil {
+			log.Printf("failed to get account: %s", tx.Error)
+			sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+			return
+		} else if count == 0 {
+			sendError(w, http.StatusBadRequest, accountNotFoundMsg)
+			return
+		}
+	}
+
+	inbox := ent.Inbox{Name: name, AccountId: req.AccountId, ExpiresAt: expiresAt}
+	smtpPass, apiKey, err := newInboxCredentials(&inbox)
+	if err != nil {
+		log.Printf("failed to generate credentials: %s", err)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	if err := s.db.Create(&inbox).Error; err != nil {
+		log.Printf("failed to create inbox %s: %s", name, err)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	s.sendInboxCredentials(w, http.StatusCreated, &inbox, smtpPass, apiKey)
+}
+
+func (s *Server) adminUpdateInbox(w http.ResponseWriter, r *http.Request) {
+	inbox := r.Context().Value(inboxContextKey).(*ent.Inbox)
+
+	var req UpdateInbox
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, http.StatusBadRequest, invalidRequestMsg)
+		return
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		sendError(w, http.StatusBadRequest, inboxNameMissingMsg)
+		return
+	}
+
+	if taken, err := s.inboxNameTaken(name, inbox.Id); err != nil {
+		log.Printf("failed to get inbox: %s", err)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	} else if taken {
+		sendError(w, http.StatusConflict, inboxExistsMsg)
+		return
+	}
+
+	inbox.Name = name
+	if err := s.db.Save(inbox).Error; err != nil {
+		log.Printf("failed to update inbox %d: %s", inbox.Id, err)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	s.sendInboxResponse(w, inbox)
+}
+
+func (s *Server) adminRotateInbox(w http.ResponseWriter, r *http.Request) {
+	inbox := r.Context().Value(inboxContextKey).(*ent.Inbox)
+
+	smtpPass, apiKey, err := newInboxCredentials(inbox)
+	if err != nil {
+		log.Printf("failed to generate credentials: %s", err)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	if err := s.db.Save(inbox).Error; err != nil {
+		log.Printf("failed to update inbox %d: %s", inbox.Id, err)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	s.sendInboxCredentials(w, http.StatusOK, inbox, smtpPass, apiKey)
+}
+
+func (s *Server) adminDeleteInbox(w http.ResponseWriter, r *http.Request) {
+	inbox := r.Context().Value(inboxContextKey).(*ent.Inbox)
+
+	result, err := s.buildInboxResponse(inbox)
+	if err != nil {
+		log.Printf("failed to get inbox %d: %s", inbox.Id, err)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	if err := s.db.Delete(inbox).Error; err != nil {
+		log.Printf("failed to delete inbox %d: %s", inbox.Id, err)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	sendResponse(w, http.StatusOK, result)
+}
@@ -0,0 +1,179 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	ent "github.com/supriyo-biswas/postbox/entities"
+	"github.com/supriyo-biswas/postbox/hub"
+	"gorm.io/gorm"
+)
+
+const (
+	keepaliveInterval = 30 * time.Second
+	wsWriteTimeout    = 10 * time.Second
+)
+
+// the default origin check is kept, since the web API authenticates with
+// credentials that browsers send on their own
+var upgrader = websocket.Upgrader{}
+
+// buildEventData returns the payload of an event: a Message for the Message*
+// events, and an Inbox for the Inbox* events. It returns nil if the message
+// no longer exists, which happens if it was deleted soon after the event.
+func (s *Server) buildEventData(inbox *ent.Inbox, e hub.Event) (any, error) {
+	if e.Data != nil {
+		return e.Data, nil
+	}
+
+	if e.EmailId == 0 {
+		return s.buildInboxResponse(inbox)
+	}
+
+	var email ent.Email
+	tx := s.db.Where("inbox_id = ? AND id = ?", inbox.Id, e.EmailId).First(&email)
+	if tx.Error != nil {
+		if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, tx.Error
+	}
+
+	return s.buildMessageResponse(&email)
+}
+
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request) {
+	inbox := r.Context().Value(inboxContextKey).(*ent.Inbox)
+
+	if s.hub == nil {
+		sendError(w, http.StatusServiceUnavailable, eventsNotConfiguredMsg)
+		return
+	}
+
+	events, unsubscribe := s.hub.Subscribe(inbox.Id)
+	defer unsubscribe()
+
+	if websocket.IsWebSocketUpgrade(r) {
+		s.streamWebSocketEvents(w, r, inbox, events)
+	} else {
+		s.streamServerSentEvents(w, r, inbox, events)
+	}
+}
+
+func (s *Server) streamServerSentEvents(
+	w http.ResponseWriter,
+	r *http.Request,
+	inbox *ent.Inbox,
+	events <-chan hub.Event,
+) {
+	rc := http.NewResponseController(w)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		log.Printf("failed to flush event stream: %s", err)
+		return
+	}
+
+	ticker := time.NewTicker(keepaliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case e := <-events:
+			data, err := s.buildEventData(inbox, e)
+			if err != nil {
+				log.Printf("failed to build %s event for inbox %d: %s", e.Type, inbox.Id, err)
+				continue
+			}
+
+			if data == nil {
+				continue
+			}
+
+			b, err := json.Marshal(data)
+			if err != nil {
+				log.Printf("failed to marshal %s event: %s", e.Type, err)
+				continue
+			}
+
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, b); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) streamWebSocketEvents(
+	w http.ResponseWriter,
+	r *http.Request,
+	inbox *ent.Inbox,
+	events <-chan hub.Event,
+) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has already sent an error response
+		return
+	}
+	defer conn.Close()
+
+	// messages from the client are discarded, but they must be read to process
+	// control frames and to notice when the connection is closed
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(keepaliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case e := <-events:
+			data, err := s.buildEventData(inbox, e)
+			if err != nil {
+				log.Printf("failed to build %s event for inbox %d: %s", e.Type, inbox.Id, err)
+				continue
+			}
+
+			if data == nil {
+				continue
+			}
+
+			conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := conn.WriteJSON(Event{Type: e.Type, Data: data}); err != nil {
+				return
+			}
+		case <-ticker.C:
+			deadline := time.Now().Add(wsWriteTimeout)
+			if err := conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
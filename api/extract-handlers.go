@@ -0,0 +1,211 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	ent "github.com/supriyo-biswas/postbox/entities"
+	"github.com/supriyo-biswas/postbox/parsemail"
+	"gorm.io/gorm"
+)
+
+const (
+	sourceSubject = "subject"
+	sourceText    = "text"
+	sourceHTML    = "html"
+)
+
+// getBodies returns the text and HTML bodies of an email, either of which may
+// be empty.
+func (s *Server) getBodies(email *ent.Email) (string, string, error) {
+	var contents []ent.EmailContent
+	tx := s.db.Select("relationship, content").Where(
+		"email_id = ? AND relationship in ?",
+		email.Id,
+		[]ent.RelType{ent.RelText, ent.RelHTML},
+	).Find(&contents)
+
+	if tx.Error != nil {
+		return "", "", tx.Error
+	}
+
+	var text, html string
+	for _, c := range contents {
+		if c.Relationship == ent.RelText {
+			text = string(c.Content)
+		} else {
+			html = string(c.Content)
+		}
+	}
+
+	return text, html, nil
+}
+
+func (s *Server) listLinks(w http.ResponseWriter, r *http.Request) {
+	email := r.Context().Value(messageContextKey).(*ent.Email)
+
+	text, html, err := s.getBodies(email)
+	if err != nil {
+		log.Printf("failed to get bodies for email %d: %s", email.Id, err)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	type key struct{ url, text, source string }
+	seen := map[key]bool{}
+	result := []Link{}
+
+	add := func(links []parsemail.Link, source string) {
+		for _, link := range links {
+			k := key{link.URL, link.Text, source}
+			if !seen[k] {
+				seen[k] = true
+				result = append(result, Link{
+					URL:    link.URL,
+					Text:   nullIfEmpty(link.Text),
+					Source: source,
+				})
+			}
+		}
+	}
+
+	add(parsemail.ExtractTextLinks(text), sourceText)
+	add(parsemail.ExtractHTMLLinks(html), sourceHTML)
+
+	sendResponse(w, http.StatusOK, result)
+}
+
+func (s *Server) listCodes(w http.ResponseWriter, r *http.Request) {
+	inbox := r.Context().Value(inboxContextKey).(*ent.Inbox)
+	email := r.Context().Value(messageContextKey).(*ent.Email)
+
+	var patterns []ent.CodePattern
+	tx := s.db.Where("inbox_id = ?", inbox.Id).Order("id").Find(&patterns)
+	if tx.Error != nil {
+		log.Printf("failed to get code patterns for inbox %d: %s", inbox.Id, tx.Error)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	// patterns are validated when they are created
+	compiled := make([]*regexp.Regexp, len(patterns))
+	patternIds := map[*regexp.Regexp]int64{}
+	for i, p := range patterns {
+		compiled[i] = regexp.MustCompile(p.Pattern)
+		patternIds[compiled[i]] = p.Id
+	}
+
+	text, html, err := s.getBodies(email)
+	if err != nil {
+		log.Printf("failed to get bodies for email %d: %s", email.Id, err)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	seen := map[string]bool{}
+	result := []Code{}
+
+	add := func(data, source string) {
+		for _, code := range parsemail.FindCodes(data, compiled) {
+			if seen[code.Code] {
+				continue
+			}
+
+			seen[code.Code] = true
+			c := Code{Code: code.Code, Source: source, Context: code.Context}
+			if code.Pattern != nil {
+				id := patternIds[code.Pattern]
+				c.PatternId = &id
+			}
+
+			result = append(result, c)
+		}
+	}
+
+	add(email.Subject, sourceSubject)
+	add(text, sourceText)
+	add(parsemail.HTMLToText(html), sourceHTML)
+
+	sendResponse(w, http.StatusOK, result)
+}
+
+func (s *Server) listCodePatterns(w http.ResponseWriter, r *http.Request) {
+	inbox := r.Context().Value(inboxContextKey).(*ent.Inbox)
+
+	var patterns []ent.CodePattern
+	tx := s.db.Where("inbox_id = ?", inbox.Id).Order("id").Find(&patterns)
+	if tx.Error != nil {
+		log.Printf("failed to get code patterns for inbox %d: %s", inbox.Id, tx.Error)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	result := make([]CodePattern, len(patterns))
+	for i, pattern := range patterns {
+		result[i] = *buildCodePatternResponse(&pattern)
+	}
+
+	sendResponse(w, http.StatusOK, result)
+}
+
+func (s *Server) createCodePattern(w http.ResponseWriter, r *http.Request) {
+	inbox := r.Context().Value(inboxContextKey).(*ent.Inbox)
+
+	var req CreateCodePattern
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, http.StatusBadRequest, invalidRequestMsg)
+		return
+	}
+
+	if _, err := regexp.Compile(req.Pattern); err != nil || req.Pattern == "" {
+		sendError(w, http.StatusBadRequest, invalidPatternMsg)
+		return
+	}
+
+	pattern := ent.CodePattern{
+		InboxId: inbox.Id,
+		Pattern: req.Pattern,
+	}
+
+	if err := s.db.Create(&pattern).Error; err != nil {
+		log.Printf("failed to create code pattern for inbox %d: %s", inbox.Id, err)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	sendResponse(w, http.StatusCreated, buildCodePatternResponse(&pattern))
+}
+
+func (s *Server) deleteCodePattern(w http.ResponseWriter, r *http.Request) {
+	inbox := r.Context().Value(inboxContextKey).(*ent.Inbox)
+	patternId, err := strconv.ParseInt(mux.Vars(r)["pattern"], 10, 64)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, invalidCodePatternIdMsg)
+		return
+	}
+
+	var pattern ent.CodePattern
+	tx := s.db.Where("inbox_id = ? AND id = ?", inbox.Id, patternId).First(&pattern)
+	if tx.Error != nil {
+		if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+			sendError(w, http.StatusNotFound, codePatternNotFoundMsg)
+		} else {
+			log.Printf("failed to get code pattern: %s", tx.Error)
+			sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		}
+		return
+	}
+
+	if err := s.db.Delete(&pattern).Error; err != nil {
+		log.Printf("failed to delete code pattern %d: %s", pattern.Id, err)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	sendResponse(w, http.StatusOK, buildCodePatternResponse(&pattern))
+}
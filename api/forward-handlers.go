@@ -0,0 +1,159 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/mail"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	ent "github.com/supriyo-biswas/postbox/entities"
+	"github.com/supriyo-biswas/postbox/relay"
+	"gorm.io/gorm"
+)
+
+const forwardSuccessMsg = "Your email message has been successfully forwarded"
+
+func (s *Server) forwardMessage(w http.ResponseWriter, r *http.Request) {
+	email := r.Context().Value(messageContextKey).(*ent.Email)
+	if s.relay == nil {
+		sendError(w, http.StatusServiceUnavailable, relayNotConfiguredMsg)
+		return
+	}
+
+	var req ForwardMessage
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, http.StatusBadRequest, invalidRequestMsg)
+		return
+	}
+
+	addr, err := mail.ParseAddress(req.Email)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, invalidRecipientMsg)
+		return
+	}
+
+	delivery, err := s.relay.Forward(s.db, email, addr.Address, nil)
+	if err != nil {
+		log.Printf("failed to forward email %d: %s", email.Id, err)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	if delivery.Status == ent.DeliveryFailed {
+		log.Printf("failed to forward email %d: %s", email.Id, delivery.Error)
+		sendError(w, http.StatusBadGateway, forwardFailedMsg)
+		return
+	}
+
+	sendResponse(w, http.StatusOK, ForwardResult{
+		Message:  forwardSuccessMsg,
+		Delivery: *buildDeliveryResponse(delivery),
+	})
+}
+
+func (s *Server) listForwards(w http.ResponseWriter, r *http.Request) {
+	email := r.Context().Value(messageContextKey).(*ent.Email)
+
+	var deliveries []ent.Delivery
+	tx := s.db.Where("email_id = ?", email.Id).Order("id").Find(&deliveries)
+	if tx.Error != nil {
+		log.Printf("failed to get deliveries for email %d: %s", email.Id, tx.Error)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	result := make([]Delivery, len(deliveries))
+	for i, delivery := range deliveries {
+		result[i] = *buildDeliveryResponse(&delivery)
+	}
+
+	sendResponse(w, http.StatusOK, result)
+}
+
+func (s *Server) listForwardRules(w http.ResponseWriter, r *http.Request) {
+	inbox := r.Context().Value(inboxContextKey).(*ent.Inbox)
+
+	var rules []ent.ForwardRule
+	tx := s.db.Where("inbox_id = ?", inbox.Id).Order("id").Find(&rules)
+	if tx.Error != nil {
+		log.Printf("failed to get forward rules for inbox %d: %s", inbox.Id, tx.Error)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	result := make([]ForwardRule, len(rules))
+	for i, rule := range rules {
+		result[i] = *buildForwardRuleResponse(&rule)
+	}
+
+	sendResponse(w, http.StatusOK, result)
+}
+
+func (s *Server) createForwardRule(w http.ResponseWriter, r *http.Request) {
+	inbox := r.Context().Value(inboxContextKey).(*ent.Inbox)
+
+	var req CreateForwardRule
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, http.StatusBadRequest, invalidRequestMsg)
+		return
+	}
+
+	addr, err := mail.ParseAddress(req.Email)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, invalidRecipientMsg)
+		return
+	}
+
+	rule := ent.ForwardRule{
+		InboxId:      inbox.Id,
+		Recipient:    addr.Address,
+		MatchFrom:    req.MatchFrom,
+		MatchTo:      req.MatchTo,
+		MatchSubject: req.MatchSubject,
+	}
+
+	if _, err := relay.CompileRule(&rule); err != nil {
+		sendError(w, http.StatusBadRequest, invalidPatternMsg)
+		return
+	}
+
+	if err := s.db.Create(&rule).Error; err != nil {
+		log.Printf("failed to create forward rule for inbox %d: %s", inbox.Id, err)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	sendResponse(w, http.StatusCreated, buildForwardRuleResponse(&rule))
+}
+
+func (s *Server) deleteForwardRule(w http.ResponseWriter, r *http.Request) {
+	inbox := r.Context().Value(inboxContextKey).(*ent.Inbox)
+	ruleId, err := strconv.ParseInt(mux.Vars(r)["rule"], 10, 64)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, invalidRuleIdMsg)
+		return
+	}
+
+	var rule ent.ForwardRule
+	tx := s.db.Where("inbox_id = ? AND id = ?", inbox.Id, ruleId).First(&rule)
+	if tx.Error != nil {
+		if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+			sendError(w, http.StatusNotFound, forwardRuleNotFoundMsg)
+		} else {
+			log.Printf("failed to get forward rule: %s", tx.Error)
+			sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		}
+		return
+	}
+
+	if err := s.db.Delete(&rule).Error; err != nil {
+		log.Printf("failed to delete forward rule %d: %s", rule.Id, err)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	sendResponse(w, http.StatusOK, buildForwardRuleResponse(&rule))
+}
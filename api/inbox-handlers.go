@@ -3,15 +3,14 @@ package api
 import (
 	"log"
 	"net/http"
-	"regexp"
+	"slices"
 	"strconv"
-	"strings"
 
 	ent "github.com/supriyo-biswas/postbox/entities"
+	"github.com/supriyo-biswas/postbox/hub"
+	"gorm.io/gorm"
 )
 
-var searchSpecial = regexp.MustCompile(`[\s%_]+`)
-
 func (s *Server) sendInboxResponse(w http.ResponseWriter, inbox *ent.Inbox) {
 	result, err := s.buildInboxResponse(inbox)
 	if err != nil {
@@ -39,6 +38,7 @@ func (s *Server) cleanInbox(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	s.publish(hub.Event{Type: hub.InboxCleaned, InboxId: id})
 	s.sendInboxResponse(w, inbox)
 }
 
@@ -53,12 +53,15 @@ func (s *Server) markReadInbox(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	s.publish(hub.Event{Type: hub.InboxUpdated, InboxId: id})
 	s.sendInboxResponse(w, inbox)
 }
 
 func (s *Server) listInboxMessages(w http.ResponseWriter, r *http.Request) {
 	inbox := r.Context().Value(inboxContextKey).(*ent.Inbox)
-	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	q := r.URL.Query()
+
+	page, err := strconv.Atoi(q.Get("page"))
 	if err != nil {
 		page = 0
 	} else if page <= 0 {
@@ -68,42 +71,155 @@ func (s *Server) listInboxMessages(w http.ResponseWriter, r *http.Request) {
 		page--
 	}
 
-	size, err := strconv.Atoi(r.URL.Query().Get("size"))
+	size, err := strconv.Atoi(q.Get("size"))
 	if err != nil {
-		size = 30
+		size = defaultPageSize
 	} else if size <= 1 {
 		sendError(w, http.StatusBadRequest, invalidRequestMsg)
 		return
 	}
+	size = min(size, maxPageSize)
 
-	tx := s.db.Limit(size).
-		Offset(page * size).
-		Order("id DESC")
+	afterId, err := parseCursor(q, "after_id")
+	if err != nil {
+		sendError(w, http.StatusBadRequest, invalidRequestMsg)
+		return
+	}
 
-	search := searchSpecial.ReplaceAllString(strings.TrimSpace(r.URL.Query().Get("search")), "%")
-	if search != "" {
-		tx = tx.Where("subject LIKE ?", "%"+search+"%")
+	beforeId, err := parseCursor(q, "before_id")
+	if err != nil {
+		sendError(w, http.StatusBadRequest, invalidRequestMsg)
+		return
 	}
 
+	searcher := &search{index: s.index}
+	base := s.db.Model(&ent.Email{}).Where("inbox_id = ? AND parent_id IS NULL", inbox.Id)
+	base, match, err := searcher.apply(base, q.Get("search"))
+	if err != nil {
+		sendError(w, http.StatusBadRequest, invalidSearchMsg)
+		return
+	}
+	base = base.Session(&gorm.Session{})
+
+	// ranked results are paged by offset, since they aren't ordered by id
+	usePages := q.Has("page") || match != ""
+	if usePages && (afterId > 0 || beforeId > 0) {
+		sendError(w, http.StatusBadRequest, invalidRequestMsg)
+		return
+	}
+
+	var total int64
+	if err := base.Count(&total).Error; err != nil {
+		log.Printf("failed to count emails: %s", err)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	tx := base
+	if afterId > 0 {
+		tx = tx.Where("id > ?", afterId)
+	}
+	if beforeId > 0 {
+		tx = tx.Where("id < ?", beforeId)
+	}
+	if match != "" {
+		tx = s.index.Rank(tx, match)
+	}
+
+	// with only after_id, the messages right after it are wanted, so they are
+	// fetched oldest first and reversed
+	backwards := afterId > 0 && beforeId == 0
+	if backwards {
+		tx = tx.Order("id")
+	} else {
+		tx = tx.Order("id DESC")
+	}
+
+	// an extra message is fetched to find out if there are more
 	var emails []ent.Email
-	tx = tx.Where("inbox_id = ?", inbox.Id).Find(&emails)
+	tx = tx.Offset(page * size).Limit(size + 1).Find(&emails)
 	if tx.Error != nil {
 		log.Printf("failed to fetch emails: %s", tx.Error)
 		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
 		return
 	}
 
-	result := make([]Message, len(emails))
-	for i, email := range emails {
-		msg, err := s.buildMessageResponse(&email)
+	more := len(emails) > size
+	if more {
+		emails = emails[:size]
+	}
+	if backwards {
+		slices.Reverse(emails)
+	}
+
+	links := &linkHeader{r: r}
+	if usePages {
+		pages := max((int(total)+size-1)/size, 1)
+		links.add("first", map[string]string{"page": "1"})
+		if page > 0 {
+			links.add("prev", map[string]string{"page": strconv.Itoa(page)})
+		}
+		if more {
+			links.add("next", map[string]string{"page": strconv.Itoa(page + 2)})
+		}
+		links.add("last", map[string]string{"page": strconv.Itoa(pages)})
+	} else {
+		links.add("first", map[string]string{"after_id": "", "before_id": ""})
+		if len(emails) > 0 {
+			newest := emails[0].Id
+			oldest := emails[len(emails)-1].Id
+
+			newer, older := more && backwards, more && !backwards
+			if !newer {
+				newer, err = exists(base.Where("id > ?", newest))
+			}
+			if err == nil && !older {
+				older, err = exists(base.Where("id < ?", oldest))
+			}
+			if err != nil {
+				log.Printf("failed to fetch emails: %s", err)
+				sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+				return
+			}
+
+			if newer {
+				id := strconv.FormatInt(newest, 10)
+				links.add("prev", map[string]string{"after_id": id, "before_id": ""})
+			}
+			if older {
+				id := strconv.FormatInt(oldest, 10)
+				links.add("next", map[string]string{"after_id": "", "before_id": id})
+			}
+		}
+	}
+
+	links.set(w)
+	w.Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
+
+	result, err := s.buildMessageResponses(emails)
+	if err != nil {
+		log.Printf("failed to get emails: %s", err)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	if match != "" && len(emails) > 0 {
+		ids := make([]int64, len(emails))
+		for i, email := range emails {
+			ids[i] = email.Id
+		}
+
+		snippets, err := s.index.Snippets(match, ids)
 		if err != nil {
-			log.Printf("failed to get email %d: %s", email.Id, err)
+			log.Printf("failed to get search snippets: %s", err)
 			sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
 			return
 		}
 
-		if msg != nil {
-			result[i] = *msg
+		for i := range result {
+			if snippet, ok := snippets[result[i].Id]; ok {
+				result[i].Snippet = &snippet
+			}
 		}
 	}
 
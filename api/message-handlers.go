@@ -3,13 +3,20 @@ package api
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"path"
+	"regexp"
 
 	ent "github.com/supriyo-biswas/postbox/entities"
+	"github.com/supriyo-biswas/postbox/hub"
 	"gorm.io/gorm"
 )
 
+var cidUrlRe = regexp.MustCompile(`(?i)cid:[^\s"'()<>]+`)
+
 func (s *Server) sendMessageResponse(w http.ResponseWriter, email *ent.Email) {
 	result, err := s.buildMessageResponse(email)
 	if err != nil {
@@ -36,6 +43,7 @@ func (s *Server) updateMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	s.publish(hub.Event{Type: hub.MessageUpdated, InboxId: email.InboxId, EmailId: email.Id})
 	s.sendMessageResponse(w, email)
 }
 
@@ -44,6 +52,27 @@ func (s *Server) getMessage(w http.ResponseWriter, r *http.Request) {
 	s.sendMessageResponse(w, email)
 }
 
+func (s *Server) listEmbeddedMessages(w http.ResponseWriter, r *http.Request) {
+	email := r.Context().Value(messageContextKey).(*ent.Email)
+
+	var children []ent.Email
+	tx := s.db.Where("parent_id = ?", email.Id).Order("id").Find(&children)
+	if tx.Error != nil {
+		log.Printf("failed to get embedded messages for email %d: %s", email.Id, tx.Error)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	result, err := s.buildMessageResponses(children)
+	if err != nil {
+		log.Printf("failed to get embedded messages for email %d: %s", email.Id, err)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	sendResponse(w, http.StatusOK, result)
+}
+
 func (s *Server) getMessageHeaders(w http.ResponseWriter, r *http.Request) {
 	email := r.Context().Value(messageContextKey).(*ent.Email)
 	multiHeaders := make(map[string][]string)
@@ -61,6 +90,25 @@ func (s *Server) getMessageHeaders(w http.ResponseWriter, r *http.Request) {
 	sendResponse(w, http.StatusOK, MessageHeaders{headers, multiHeaders})
 }
 
+// deleteEmail deletes an email along with the emails embedded in it, at any
+// depth.
+func (s *Server) deleteEmail(email *ent.Email) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		ids := []int64{email.Id}
+		for parents := ids; len(parents) > 0; {
+			var children []int64
+			if err := tx.Model(&ent.Email{}).Where("parent_id IN ?", parents).Pluck("id", &children).Error; err != nil {
+				return err
+			}
+
+			ids = append(ids, children...)
+			parents = children
+		}
+
+		return tx.Where("id IN ?", ids).Delete(&ent.Email{}).Error
+	})
+}
+
 func (s *Server) deleteMessage(w http.ResponseWriter, r *http.Request) {
 	email := r.Context().Value(messageContextKey).(*ent.Email)
 
@@ -71,35 +119,43 @@ func (s *Server) deleteMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := s.db.Delete(&email).Error; err != nil {
+	if err := s.deleteEmail(email); err != nil {
 		log.Printf("failed to delete email %d: %s", email.Id, err)
 		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
 		return
 	}
 
+	s.publish(hub.Event{Type: hub.MessageDeleted, InboxId: email.InboxId, EmailId: email.Id, Data: result})
 	sendResponse(w, http.StatusOK, result)
 }
 
-func (s *Server) getAndSendContent(w http.ResponseWriter, id int64, rel ent.RelType) {
-	var content ent.EmailContent
-	tx := s.db.Where("email_id = ? AND relationship = ?", id, rel).First(&content)
+// getAndSendContent sends the first of the given kinds of content that the
+// email has.
+func (s *Server) getAndSendContent(w http.ResponseWriter, id int64, rels ...ent.RelType) {
+	var contents []ent.EmailContent
+	tx := s.db.Where("email_id = ? AND relationship in ?", id, rels).Find(&contents)
 	if tx.Error != nil {
-		if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
-			http.Error(w, "", http.StatusNotFound)
-		} else {
-			log.Printf("failed to get %s for email %d: %s", rel, id, tx.Error)
-			sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
-		}
+		log.Printf("failed to get %s for email %d: %s", rels[0], id, tx.Error)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
 		return
 	}
 
-	w.Header().Set("Content-Type", content.MimeType)
-	w.Write(content.Content)
+	for _, rel := range rels {
+		for _, content := range contents {
+			if content.Relationship == rel {
+				w.Header().Set("Content-Type", contentType(&content))
+				w.Write(content.Content)
+				return
+			}
+		}
+	}
+
+	http.Error(w, "", http.StatusNotFound)
 }
 
 func (s *Server) getTextBody(w http.ResponseWriter, r *http.Request) {
 	email := r.Context().Value(messageContextKey).(*ent.Email)
-	s.getAndSendContent(w, email.Id, ent.RelText)
+	s.getAndSendContent(w, email.Id, ent.RelText, ent.RelHTMLText)
 }
 
 func (s *Server) getHTMLBody(w http.ResponseWriter, r *http.Request) {
@@ -127,22 +183,99 @@ func (s *Server) getSanitizedHTMLBody(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sanitized, err := s.sanitizer.Sanitize(content.Content)
+	html, err := s.rewriteCidUrls(r, email.Id, content.Content)
+	if err != nil {
+		log.Printf("failed to get embedded files for email %d: %s", email.Id, err)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	sanitized, err := s.sanitizer.Sanitize(html)
 	if err != nil {
 		log.Printf("sanitizer failed for email %d: %s", email.Id, err)
 		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
 		return
 	}
 
-	w.Header().Set("Content-Type", content.MimeType)
+	w.Header().Set("Content-Type", contentType(&content))
 	w.Write(sanitized)
 }
 
+// rewriteCidUrls replaces cid: URLs in an HTML body with the download URLs of
+// the matching parts, so that inline images can be displayed. The URLs are
+// derived from the path of the request, so that they work for every API
+// prefix, and also when the HTML is rendered with a different base URL.
+func (s *Server) rewriteCidUrls(r *http.Request, emailId int64, html []byte) ([]byte, error) {
+	if !cidUrlRe.Match(html) {
+		return html, nil
+	}
+
+	var parts []ent.EmailContent
+	tx := s.db.Select("id, content_id").Where(
+		"email_id = ? AND relationship in ? AND content_id != ''",
+		emailId,
+		[]ent.RelType{ent.RelAttach, ent.RelEmbedded},
+	).Find(&parts)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+
+	base := path.Dir(r.URL.EscapedPath())
+	suffix := ""
+	if token := r.URL.Query().Get("api_token"); token != "" {
+		suffix = "?" + url.Values{"api_token": {token}}.Encode()
+	}
+
+	urls := make(map[string]string, len(parts))
+	for _, part := range parts {
+		urls[part.ContentId] = fmt.Sprintf("%s/attachments/%d/download%s", base, part.Id, suffix)
+	}
+
+	return cidUrlRe.ReplaceAllFunc(html, func(m []byte) []byte {
+		cid, err := url.PathUnescape(string(m[len("cid:"):]))
+		if err != nil {
+			return m
+		}
+
+		if u, ok := urls[cid]; ok {
+			return []byte(u)
+		}
+
+		return m
+	}), nil
+}
+
+func (s *Server) listCalendarEvents(w http.ResponseWriter, r *http.Request) {
+	email := r.Context().Value(messageContextKey).(*ent.Email)
+
+	var events []ent.CalendarEvent
+	tx := s.db.Where("email_id = ?", email.Id).Order("id").Find(&events)
+	if tx.Error != nil {
+		log.Printf("failed to get calendar events for email %d: %s", email.Id, tx.Error)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	result := make([]CalendarEvent, len(events))
+	for i, event := range events {
+		ev, err := buildCalendarEventResponse(&event)
+		if err != nil {
+			log.Printf("failed to build calendar event response for email %d: %s", email.Id, err)
+			sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+			return
+		}
+
+		result[i] = *ev
+	}
+
+	sendResponse(w, http.StatusOK, result)
+}
+
 func (s *Server) listAttachments(w http.ResponseWriter, r *http.Request) {
 	email := r.Context().Value(messageContextKey).(*ent.Email)
 
 	var attachments []ent.EmailContent
-	tx := s.db.Select("id, relationship, email_id, mime_type, file_name, size").Where(
+	tx := s.db.Select("id, relationship, email_id, mime_type, charset, content_id, file_name, size").Where(
 		"email_id = ? and relationship in ?",
 		email.Id,
 		[]ent.RelType{ent.RelAttach, ent.RelEmbedded},
@@ -191,7 +324,7 @@ func (s *Server) downloadAttachment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Header().Set("Content-Type", content.MimeType)
-	w.Header().Set("Content-Disposition", "attachment; filename=\""+content.FileName+"\"")
+	w.Header().Set("Content-Type", contentType(&content))
+	w.Header().Set("Content-Disposition", contentDisposition(content.FileName))
 	w.Write(content.Content)
 }
@@ -2,11 +2,13 @@ package api
 
 import (
 	"context"
+	"crypto/subtle"
 	"errors"
 	"log"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	ent "github.com/supriyo-biswas/postbox/entities"
@@ -17,6 +19,21 @@ import (
 const inboxContextKey ServerContextKey = "inbox"
 const messageContextKey ServerContextKey = "message"
 const attachmentContextKey ServerContextKey = "attachment"
+const accountContextKey ServerContextKey = "account"
+const sessionContextKey ServerContextKey = "session"
+
+const (
+	sessionCookieName = "postbox_session"
+	sessionLifetime   = 7 * 24 * time.Hour
+	csrfTokenHeader   = "X-CSRF-Token"
+)
+
+// lastUsedInterval is how often the last use of an API key is recorded.
+const lastUsedInterval = time.Minute
+
+// adminScopePaths are the parts of the paths of the inbox APIs that need the
+// admin scope.
+var adminScopePaths = []string{"/forward_rules", "/code_patterns", "/webhooks"}
 
 func (s *Server) applyBodyLimit(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -42,6 +59,10 @@ func (s *Server) enforceBasicAuth(next http.Handler) http.Handler {
 
 		var inbox ent.Inbox
 		tx := s.db.Where("name = ?", u).First(&inbox)
+		if tx.Error == nil && inbox.Expired() {
+			tx.Error = gorm.ErrRecordNotFound
+		}
+
 		if tx.Error != nil {
 			if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
 				w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
@@ -54,92 +75,444 @@ func (s *Server) enforceBasicAuth(next http.Handler) http.Handler {
 			return
 		}
 
-		res, err := utils.VerifySecret(p, inbox.ApiKey)
+		if status, msg := s.authorizeKey(r, &inbox, p); status == http.StatusUnauthorized {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
+			sendError(w, http.StatusUnauthorized, basicAuthFailedMsg)
+			return
+		} else if status != 0 {
+			sendError(w, status, msg)
+			return
+		}
+
+		ctx := r.Context()
+		ctx = context.WithValue(ctx, inboxContextKey, &inbox)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requiredScope returns the scope an API key needs for a request.
+func requiredScope(r *http.Request) ent.ApiKeyScope {
+	if route := mux.CurrentRoute(r); route != nil {
+		if tpl, err := route.GetPathTemplate(); err == nil {
+			for _, p := range adminScopePaths {
+				if strings.Contains(tpl, p) {
+					return ent.ScopeAdmin
+				}
+			}
+		}
+	}
+
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return ent.ScopeRead
+	}
+
+	return ent.ScopeWrite
+}
+
+// authorizeKey checks that a key allows a request to an inbox. The inbox's
+// own API key and the token of its account allow every request, and its
+// other API keys allow requests in their scopes until they expire. It
+// returns the status and message of the error response to send if the key
+// doesn't allow the request, or zero if it does.
+func (s *Server) authorizeKey(r *http.Request, inbox *ent.Inbox, key string) (int, string) {
+	if res, err := utils.VerifySecret(key, inbox.ApiKey); err != nil {
+		log.Printf("failed to verify secret for inbox %d: %s", inbox.Id, err)
+		return http.StatusInternalServerError, internalServerErrorMsg
+	} else if res {
+		return 0, ""
+	}
+
+	hash := utils.HashSecret(key)
+	if inbox.AccountId != nil {
+		var count int64
+		tx := s.db.Model(&ent.Account{}).Where("id = ? AND token_hash = ?", *inbox.AccountId, hash).Count(&count)
+		if tx.Error != nil {
+			log.Printf("failed to get account: %s", tx.Error)
+			return http.StatusInternalServerError, internalServerErrorMsg
+		}
+
+		if count > 0 {
+			return 0, ""
+		}
+	}
+
+	var apiKey ent.ApiKey
+	tx := s.db.Where("inbox_id = ? AND key_hash = ?", inbox.Id, hash).First(&apiKey)
+	if tx.Error == nil && apiKey.Expired() {
+		tx.Error = gorm.ErrRecordNotFound
+	}
+
+	if tx.Error != nil {
+		if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+			return http.StatusUnauthorized, invalidApiKeyMsg
+		}
+
+		log.Printf("failed to get API key: %s", tx.Error)
+		return http.StatusInternalServerError, internalServerErrorMsg
+	}
+
+	if !apiKey.HasScope(requiredScope(r)) {
+		return http.StatusForbidden, apiKeyScopeMsg
+	}
+
+	// only record the last use periodically, to avoid writing to the
+	// database on every request
+	now := time.Now()
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) >= lastUsedInterval {
+		err := s.db.Model(&apiKey).UpdateColumn("last_used_at", now).Error
+		if err != nil {
+			log.Printf("failed to update API key %d: %s", apiKey.Id, err)
+		}
+	}
+
+	return 0, ""
+}
+
+// findSession returns the unexpired session whose token is in a request's
+// session cookie, or nil if there isn't one.
+func (s *Server) findSession(r *http.Request) (*ent.Session, error) {
+	c, err := r.Cookie(sessionCookieName)
+	if err != nil || c.Value == "" {
+		return nil, nil
+	}
+
+	var session ent.Session
+	tx := s.db.Where("token_hash = ?", utils.HashSecret(c.Value)).First(&session)
+	if tx.Error != nil {
+		if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, tx.Error
+	}
+
+	if session.Expired() {
+		return nil, nil
+	}
+
+	return &session, nil
+}
+
+// checkCsrfToken reports whether a request that uses a session either can't
+// change anything, or has the session's CSRF token in its header.
+func checkCsrfToken(r *http.Request, session *ent.Session) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+
+	token := r.Header.Get(csrfTokenHeader)
+	return subtle.ConstantTimeCompare([]byte(token), []byte(session.CsrfToken)) == 1
+}
+
+// bindSession finds the session of a request, and checks its CSRF token. It
+// sends an error response and returns nil if either of them fail. If
+// basicAuth is true, the browser is asked for basic auth credentials when
+// there's no session.
+func (s *Server) bindSession(w http.ResponseWriter, r *http.Request, basicAuth bool) *ent.Session {
+	session, err := s.findSession(r)
+	if err != nil {
+		log.Printf("failed to get session: %s", err)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return nil
+	}
+
+	if session == nil {
+		// the browser's login prompt for basic auth is only shown until
+		// users are added or OIDC is set up, after which the web interface
+		// shows a login form
+		if basicAuth && s.oidc == nil {
+			var users int64
+			if err := s.db.Model(&ent.User{}).Count(&users).Error; err != nil {
+				log.Printf("failed to count users: %s", err)
+			} else if users == 0 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
+			}
+		}
+
+		sendError(w, http.StatusUnauthorized, notLoggedInMsg)
+		return nil
+	}
+
+	if !checkCsrfToken(r, session) {
+		sendError(w, http.StatusForbidden, invalidCsrfTokenMsg)
+		return nil
+	}
+
+	return session
+}
+
+// enforceSession authenticates requests to the web APIs that are about the
+// logged in user, rather than an inbox.
+func (s *Server) enforceSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := s.bindSession(w, r, false)
+		if session == nil {
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), sessionContextKey, session)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// findMemberInbox returns an inbox that a user is a member of, along with
+// their role in it. It returns a nil inbox if the user isn't a member of it,
+// or it has expired.
+func (s *Server) findMemberInbox(userId, inboxId int64) (*ent.Inbox, ent.MembershipRole, error) {
+	var membership ent.Membership
+	tx := s.db.Where("user_id = ? AND inbox_id = ?", userId, inboxId).First(&membership)
+	if tx.Error != nil {
+		if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+			return nil, "", nil
+		}
+		return nil, "", tx.Error
+	}
+
+	var inbox ent.Inbox
+	if tx := s.db.First(&inbox, inboxId); tx.Error != nil {
+		if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+			return nil, "", nil
+		}
+		return nil, "", tx.Error
+	}
+
+	if inbox.Expired() {
+		return nil, "", nil
+	}
+
+	return &inbox, membership.Role, nil
+}
+
+// enforceWebAuth authenticates requests to the web APIs for an inbox. Users
+// that are logged in access the inbox they've chosen, within the limits of
+// their role in it, and requests with basic auth credentials access the
+// inbox in them.
+func (s *Server) enforceWebAuth(next http.Handler) http.Handler {
+	basicAuth := s.enforceBasicAuth(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := r.BasicAuth(); ok {
+			basicAuth.ServeHTTP(w, r)
+			return
+		}
+
+		session := s.bindSession(w, r, true)
+		if session == nil {
+			return
+		}
+
+		if session.InboxId == nil {
+			sendError(w, http.StatusBadRequest, noInboxSelectedMsg)
+			return
+		}
+
+		inbox, role, err := s.findMemberInbox(session.UserId, *session.InboxId)
 		if err != nil {
-			log.Printf("failed to verify secret for %s: %s", p, err)
+			log.Printf("failed to get inbox: %s", err)
 			sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
 			return
+		} else if inbox == nil {
+			sendError(w, http.StatusNotFound, inboxNotFoundMsg)
+			return
 		}
 
-		if !res {
-			w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
-			sendError(w, http.StatusUnauthorized, basicAuthFailedMsg)
+		if !role.Allows(requiredScope(r)) {
+			sendError(w, http.StatusForbidden, roleForbiddenMsg)
 			return
 		}
 
-		ctx := r.Context()
-		ctx = context.WithValue(ctx, inboxContextKey, &inbox)
+		ctx := context.WithValue(r.Context(), sessionContextKey, session)
+		ctx = context.WithValue(ctx, inboxContextKey, inbox)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// getAuthToken returns the token that authenticates an API request, or an
+// error message if it is missing or malformed.
+func getAuthToken(r *http.Request) (string, string) {
+	var key string
+	authHeader := r.Header.Get("Authorization")
+	queryToken := r.URL.Query().Get("api_token")
+	headerToken := r.Header.Get("Api-Token")
+
+	if authHeader != "" {
+		parts := strings.SplitN(authHeader, " ", 2)
+		if len(parts) < 2 {
+			return "", missingAuthTokenMsg
+		}
+
+		authType := strings.ToLower(parts[0])
+		if authType != "bearer" && authType != "token" {
+			return "", unknownAuthTypeMsg
+		}
+
+		key = parts[1]
+	} else if queryToken != "" {
+		key = queryToken
+	} else if headerToken != "" {
+		key = headerToken
+	}
+
+	if key == "" {
+		return "", missingAuthTokenMsg
+	}
+
+	return key, ""
+}
+
+// findInbox looks up the inbox in the request path, which is either its id
+// or its name, and sends an error response if it can't be found.
+func (s *Server) findInbox(w http.ResponseWriter, r *http.Request) *ent.Inbox {
+	name := mux.Vars(r)["inbox"]
+	if name == "" {
+		sendError(w, http.StatusBadRequest, inboxNameMissingMsg)
+		return nil
+	}
+
+	var tx *gorm.DB
+	var inbox ent.Inbox
+	if id, err := strconv.ParseInt(name, 10, 64); err == nil {
+		tx = s.db.Where("id = ? or name = ?", id, name).First(&inbox)
+	} else {
+		tx = s.db.Where("name = ?", name).First(&inbox)
+	}
+
+	if tx.Error != nil {
+		if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+			sendError(w, http.StatusNotFound, inboxNotFoundMsg)
+		} else {
+			log.Printf("failed to get inbox: %s", tx.Error)
+			sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		}
+		return nil
+	}
+
+	if inbox.Expired() {
+		sendError(w, http.StatusNotFound, inboxNotFoundMsg)
+		return nil
+	}
+
+	return &inbox
+}
+
 func (s *Server) bindInbox(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		name := mux.Vars(r)["inbox"]
-		if name == "" {
+		if mux.Vars(r)["inbox"] == "" {
 			sendError(w, http.StatusBadRequest, inboxNameMissingMsg)
 			return
 		}
 
-		var key string
-		authHeader := r.Header.Get("Authorization")
-		queryToken := r.URL.Query().Get("api_token")
-		headerToken := r.Header.Get("Api-Token")
+		key, msg := getAuthToken(r)
+		if msg != "" {
+			sendError(w, http.StatusBadRequest, msg)
+			return
+		}
 
-		if authHeader != "" {
-			parts := strings.SplitN(authHeader, " ", 2)
-			if len(parts) < 2 {
-				sendError(w, http.StatusBadRequest, missingAuthTokenMsg)
+		inbox := s.findInbox(w, r)
+		if inbox == nil {
+			return
+		}
+
+		// inboxes that belong to an account can only be accessed through
+		// it in the v2 API
+		if v, ok := mux.Vars(r)["account"]; ok {
+			accountId, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				sendError(w, http.StatusBadRequest, invalidAccountIdMsg)
 				return
 			}
 
-			authType := strings.ToLower(parts[0])
-			if authType != "bearer" && authType != "token" {
-				sendError(w, http.StatusBadRequest, unknownAuthTypeMsg)
+			if inbox.AccountId != nil && *inbox.AccountId != accountId {
+				sendError(w, http.StatusNotFound, inboxNotFoundMsg)
 				return
 			}
+		}
 
-			key = parts[1]
-		} else if queryToken != "" {
-			key = queryToken
-		} else if headerToken != "" {
-			key = headerToken
+		if status, msg := s.authorizeKey(r, inbox, key); status != 0 {
+			sendError(w, status, msg)
+			return
 		}
 
-		if key == "" {
-			sendError(w, http.StatusBadRequest, missingAuthTokenMsg)
+		ctx := r.Context()
+		ctx = context.WithValue(ctx, inboxContextKey, inbox)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// enforceAdminToken authenticates requests to the admin API with the admin
+// token from the server config. The admin API is disabled if it isn't set.
+func (s *Server) enforceAdminToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.adminToken == "" {
+			sendError(w, http.StatusForbidden, adminApiDisabledMsg)
 			return
 		}
 
-		var tx *gorm.DB
-		var inbox ent.Inbox
-		if id, err := strconv.ParseInt(name, 10, 64); err == nil {
-			tx = s.db.Where("id = ? or name = ?", id, name).First(&inbox)
-		} else {
-			tx = s.db.Where("name = ?", name).First(&inbox)
+		key, msg := getAuthToken(r)
+		if msg != "" {
+			sendError(w, http.StatusBadRequest, msg)
+			return
+		}
+
+		if subtle.ConstantTimeCompare([]byte(key), []byte(s.adminToken)) != 1 {
+			sendError(w, http.StatusUnauthorized, invalidAdminTokenMsg)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// enforceAccountToken authenticates requests to the account APIs with an
+// account token, and binds the account. If the path has an account id, it
+// must be the token's account.
+func (s *Server) enforceAccountToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, msg := getAuthToken(r)
+		if msg != "" {
+			sendError(w, http.StatusBadRequest, msg)
+			return
 		}
 
+		var account ent.Account
+		tx := s.db.Where("token_hash = ?", utils.HashSecret(key)).First(&account)
 		if tx.Error != nil {
 			if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
-				sendError(w, http.StatusNotFound, inboxNotFoundMsg)
+				sendError(w, http.StatusUnauthorized, invalidAccountTokenMsg)
 			} else {
-				log.Printf("failed to get inbox: %s", tx.Error)
+				log.Printf("failed to get account: %s", tx.Error)
 				sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
 			}
 			return
 		}
 
-		if res, err := utils.VerifySecret(key, inbox.ApiKey); err != nil {
-			log.Printf("failed to verify secret for %s: %s", key, err)
-			sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
-			return
-		} else if !res {
-			sendError(w, http.StatusUnauthorized, invalidApiKeyMsg)
+		if v, ok := mux.Vars(r)["account"]; ok {
+			accountId, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				sendError(w, http.StatusBadRequest, invalidAccountIdMsg)
+				return
+			}
+
+			if accountId != account.Id {
+				sendError(w, http.StatusNotFound, accountNotFoundMsg)
+				return
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), accountContextKey, &account)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// bindAdminInbox binds the inbox in the path of an admin API request, like
+// bindInbox does without checking the inbox's API key.
+func (s *Server) bindAdminInbox(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inbox := s.findInbox(w, r)
+		if inbox == nil {
 			return
 		}
 
-		ctx := r.Context()
-		ctx = context.WithValue(ctx, inboxContextKey, &inbox)
+		ctx := context.WithValue(r.Context(), inboxContextKey, inbox)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
@@ -181,7 +554,7 @@ func (s *Server) bindAttachment(h http.Handler) http.Handler {
 		}
 
 		content := &ent.EmailContent{}
-		tx := s.db.Select("id, relationship, email_id, mime_type, file_name, size").Where(
+		tx := s.db.Select("id, relationship, email_id, mime_type, charset, content_id, file_name, size").Where(
 			"email_id = ? AND id = ? AND relationship in ?",
 			email.Id,
 			attachmentId,
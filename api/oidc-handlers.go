@@ -0,0 +1,254 @@
+package api
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	ent "github.com/supriyo-biswas/postbox/entities"
+	"github.com/supriyo-biswas/postbox/oidc"
+	"github.com/supriyo-biswas/postbox/utils"
+	"gorm.io/gorm"
+)
+
+const (
+	oidcCookieName   = "postbox_oidc"
+	oidcLoginTimeout = 10 * time.Minute
+)
+
+var errOidcUserExists = errors.New("a user with the same username already exists")
+
+// OidcGroup gives the members of a group at the identity provider a role in
+// the inboxes whose names match any of the patterns.
+type OidcGroup struct {
+	Group   string
+	Inboxes []string
+	Role    ent.MembershipRole
+}
+
+// OidcLogin configures logging in to the web interface with an OpenID
+// Connect provider.
+type OidcLogin struct {
+	Provider      *oidc.Provider
+	UsernameClaim string
+	GroupsClaim   string
+	Groups        []OidcGroup
+}
+
+func setOidcCookie(w http.ResponseWriter, r *http.Request, value string) {
+	c := &http.Cookie{
+		Name:     oidcCookieName,
+		Value:    value,
+		Path:     "/web/api/oidc",
+		MaxAge:   int(oidcLoginTimeout / time.Second),
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+
+	if value == "" {
+		c.MaxAge = -1
+	}
+
+	http.SetCookie(w, c)
+}
+
+func (s *Server) getLoginOptions(w http.ResponseWriter, r *http.Request) {
+	sendResponse(w, http.StatusOK, LoginOptions{Oidc: s.oidc != nil})
+}
+
+// oidcLogin sends the user to the identity provider. The state, nonce and
+// PKCE code verifier of the login are kept in a cookie until they return.
+func (s *Server) oidcLogin(w http.ResponseWriter, r *http.Request) {
+	if s.oidc == nil {
+		sendError(w, http.StatusNotFound, oidcNotConfiguredMsg)
+		return
+	}
+
+	var values [3]string
+	for i := range values {
+		v, err := utils.RandomString(32)
+		if err != nil {
+			log.Printf("failed to generate OIDC login state: %s", err)
+			sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+			return
+		}
+		values[i] = v
+	}
+
+	state, nonce, verifier := values[0], values[1], values[2]
+	u, err := s.oidc.Provider.AuthCodeURL(r.Context(), state, nonce, verifier)
+	if err != nil {
+		log.Printf("failed to start OIDC login: %s", err)
+		sendError(w, http.StatusBadGateway, oidcProviderErrorMsg)
+		return
+	}
+
+	setOidcCookie(w, r, strings.Join(values[:], "."))
+	http.Redirect(w, r, u, http.StatusFound)
+}
+
+func (s *Server) oidcCallback(w http.ResponseWriter, r *http.Request) {
+	if s.oidc == nil {
+		sendError(w, http.StatusNotFound, oidcNotConfiguredMsg)
+		return
+	}
+
+	var values []string
+	if c, err := r.Cookie(oidcCookieName); err == nil {
+		values = strings.Split(c.Value, ".")
+	}
+
+	// the login can only be completed once
+	setOidcCookie(w, r, "")
+
+	q := r.URL.Query()
+	if len(values) != 3 || subtle.ConstantTimeCompare([]byte(q.Get("state")), []byte(values[0])) != 1 {
+		sendError(w, http.StatusBadRequest, invalidOidcStateMsg)
+		return
+	}
+
+	if e := q.Get("error"); e != "" {
+		log.Printf("OIDC login failed: %s: %s", e, q.Get("error_description"))
+		sendError(w, http.StatusUnauthorized, oidcLoginFailedMsg)
+		return
+	}
+
+	claims, err := s.oidc.Provider.Exchange(r.Context(), q.Get("code"), values[1], values[2])
+	if err != nil {
+		log.Printf("OIDC login failed: %s", err)
+		sendError(w, http.StatusUnauthorized, oidcLoginFailedMsg)
+		return
+	}
+
+	user, err := s.findOidcUser(claims)
+	if errors.Is(err, errOidcUserExists) {
+		sendError(w, http.StatusConflict, oidcUserExistsMsg)
+		return
+	} else if err != nil {
+		log.Printf("failed to get OIDC user %s: %s", claims.String("sub"), err)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	if err := s.syncOidcMemberships(user, claims.Strings(s.oidc.GroupsClaim)); err != nil {
+		log.Printf("failed to update memberships of user %d: %s", user.Id, err)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	if _, err := s.startSession(w, r, user); err != nil {
+		log.Printf("failed to create session for user %d: %s", user.Id, err)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	http.Redirect(w, r, "/web/", http.StatusSeeOther)
+}
+
+// findOidcUser returns the user with the subject of an ID token, and adds
+// them if they are logging in for the first time.
+func (s *Server) findOidcUser(claims oidc.Claims) (*ent.User, error) {
+	subject := claims.String("sub")
+
+	var user ent.User
+	err := s.db.Where("oidc_subject = ?", subject).First(&user).Error
+	if err == nil {
+		return &user, nil
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	username := claims.String(s.oidc.UsernameClaim)
+	if username == "" {
+		username = claims.String("email")
+	}
+	if username == "" {
+		username = subject
+	}
+
+	// users that were added with a password aren't taken over by logging
+	// in with the same username
+	var count int64
+	if err := s.db.Model(&ent.User{}).Where("username = ?", username).Count(&count).Error; err != nil {
+		return nil, err
+	}
+
+	if count > 0 {
+		return nil, errOidcUserExists
+	}
+
+	user = ent.User{Username: username, OidcSubject: &subject}
+	if err := s.db.Create(&user).Error; err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// syncOidcMemberships gives a user the roles of their groups, and removes
+// them from the other inboxes. If there are no groups in the configuration,
+// memberships are left to be managed with the CLI.
+func (s *Server) syncOidcMemberships(user *ent.User, groups []string) error {
+	if len(s.oidc.Groups) == 0 {
+		return nil
+	}
+
+	var inboxes []ent.Inbox
+	if err := s.db.Select("id", "name").Find(&inboxes).Error; err != nil {
+		return err
+	}
+
+	// members of several groups get the highest of their roles
+	roles := map[int64]ent.MembershipRole{}
+	for _, g := range s.oidc.Groups {
+		if !slices.Contains(groups, g.Group) {
+			continue
+		}
+
+		for _, inbox := range inboxes {
+			matched := slices.ContainsFunc(g.Inboxes, func(pattern string) bool {
+				ok, _ := path.Match(pattern, inbox.Name)
+				return ok
+			})
+
+			rank := slices.Index(ent.MembershipRoles, g.Role)
+			if matched && rank > slices.Index(ent.MembershipRoles, roles[inbox.Id]) {
+				roles[inbox.Id] = g.Role
+			}
+		}
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		ids := make([]int64, 0, len(roles))
+		for id := range roles {
+			ids = append(ids, id)
+		}
+
+		q := tx.Where("user_id = ?", user.Id)
+		if len(ids) > 0 {
+			q = q.Where("inbox_id NOT IN ?", ids)
+		}
+
+		if err := q.Delete(&ent.Membership{}).Error; err != nil {
+			return err
+		}
+
+		for id, role := range roles {
+			membership := ent.Membership{UserId: user.Id, InboxId: id, Role: role}
+			err := tx.Where("user_id = ? AND inbox_id = ?", user.Id, id).
+				Assign(ent.Membership{Role: role}).
+				FirstOrCreate(&membership).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
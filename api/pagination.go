@@ -0,0 +1,70 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+const (
+	defaultPageSize = 30
+	maxPageSize     = 100
+)
+
+// parseCursor returns the message id in a cursor parameter, or zero if the
+// parameter isn't present.
+func parseCursor(q url.Values, name string) (int64, error) {
+	if !q.Has(name) {
+		return 0, nil
+	}
+
+	id, err := strconv.ParseInt(q.Get(name), 10, 64)
+	if err != nil || id <= 0 {
+		return 0, errors.New("invalid cursor")
+	}
+
+	return id, nil
+}
+
+// linkHeader builds an RFC 8288 Link header from relation types and the
+// query parameters to set on the request URL for each of them. Parameters
+// with empty values are removed.
+type linkHeader struct {
+	r     *http.Request
+	links []string
+}
+
+func (l *linkHeader) add(rel string, params map[string]string) {
+	q := l.r.URL.Query()
+	for k, v := range params {
+		if v == "" {
+			q.Del(k)
+		} else {
+			q.Set(k, v)
+		}
+	}
+
+	u := url.URL{Path: l.r.URL.Path, RawQuery: q.Encode()}
+	l.links = append(l.links, fmt.Sprintf(`<%s>; rel="%s"`, u.String(), rel))
+}
+
+func (l *linkHeader) set(w http.ResponseWriter) {
+	if len(l.links) > 0 {
+		w.Header().Set("Link", strings.Join(l.links, ", "))
+	}
+}
+
+// exists reports whether a query matches any rows.
+func exists(tx *gorm.DB) (bool, error) {
+	var ids []int64
+	if err := tx.Limit(1).Pluck("id", &ids).Error; err != nil {
+		return false, err
+	}
+
+	return len(ids) > 0, nil
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	ent "github.com/supriyo-biswas/postbox/entities"
+	"github.com/supriyo-biswas/postbox/parsemail"
+	"gorm.io/gorm"
+)
+
+// loadMessageTree parses the MIME tree of a message from its raw source. The
+// tree is not stored, so that it is available for messages received before
+// the tree parser was added. On failure, an error response is sent and a nil
+// tree is returned.
+func (s *Server) loadMessageTree(w http.ResponseWriter, email *ent.Email) ([]byte, *parsemail.Part) {
+	var content ent.EmailContent
+	tx := s.db.Where("email_id = ? AND relationship = ?", email.Id, ent.RelRaw).First(&content)
+	if tx.Error != nil {
+		if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+			sendError(w, http.StatusNotFound, partNotFoundMsg)
+		} else {
+			log.Printf("failed to get raw source for email %d: %s", email.Id, tx.Error)
+			sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		}
+		return nil, nil
+	}
+
+	root, err := parsemail.ParseTree(content.Content)
+	if err != nil {
+		log.Printf("failed to parse MIME tree for email %d: %s", email.Id, err)
+		sendError(w, http.StatusUnprocessableEntity, messageParseFailedMsg)
+		return nil, nil
+	}
+
+	return content.Content, root
+}
+
+func (s *Server) getMessageParts(w http.ResponseWriter, r *http.Request) {
+	email := r.Context().Value(messageContextKey).(*ent.Email)
+	_, root := s.loadMessageTree(w, email)
+	if root == nil {
+		return
+	}
+
+	sendResponse(w, http.StatusOK, buildPartResponse(root))
+}
+
+func (s *Server) getMessagePartRaw(w http.ResponseWriter, r *http.Request) {
+	email := r.Context().Value(messageContextKey).(*ent.Email)
+	data, root := s.loadMessageTree(w, email)
+	if root == nil {
+		return
+	}
+
+	part, err := root.Find(mux.Vars(r)["path"])
+	if err != nil {
+		sendError(w, http.StatusNotFound, partNotFoundMsg)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(part.Raw(data))
+}
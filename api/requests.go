@@ -7,3 +7,42 @@ type UpdateMessageParams struct {
 type UpdateMessage struct {
 	Message UpdateMessageParams `json:"message"`
 }
+
+type ForwardMessage struct {
+	Email string `json:"email"`
+}
+
+type CreateForwardRule struct {
+	Email        string `json:"email"`
+	MatchFrom    string `json:"match_from"`
+	MatchTo      string `json:"match_to"`
+	MatchSubject string `json:"match_subject"`
+}
+
+type CreateCodePattern struct {
+	Pattern string `json:"pattern"`
+}
+
+type CreateWebhook struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+}
+
+type CreateInbox struct {
+	Name      string `json:"name"`
+	TTL       *int64 `json:"ttl"`
+	AccountId *int64 `json:"account_id"`
+}
+
+type UpdateInbox struct {
+	Name string `json:"name"`
+}
+
+type Login struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type UpdateSession struct {
+	InboxId *int64 `json:"inbox_id"`
+}
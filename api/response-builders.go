@@ -1,20 +1,106 @@
 package api
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"mime"
+	"strings"
 
 	"github.com/dustin/go-humanize"
 	ent "github.com/supriyo-biswas/postbox/entities"
+	"github.com/supriyo-biswas/postbox/parsemail"
 	"gorm.io/gorm"
 )
 
 func (s *Server) buildMessageResponse(email *ent.Email) (*Message, error) {
-	var recipients []ent.Address
-	err := s.db.Where("email_id = ?", email.Id).Find(&recipients).Error
+	result, err := s.buildMessageResponses([]ent.Email{*email})
+	if err != nil {
+		return nil, err
+	}
+
+	return &result[0], nil
+}
+
+// buildMessageResponses builds the responses of several emails with a fixed
+// number of queries, rather than a few for each email.
+func (s *Server) buildMessageResponses(emails []ent.Email) ([]Message, error) {
+	if len(emails) == 0 {
+		return []Message{}, nil
+	}
+
+	ids := make([]int64, len(emails))
+	for i, email := range emails {
+		ids[i] = email.Id
+	}
+
+	var addresses []ent.Address
+	err := s.db.Where("email_id IN ?", ids).Find(&addresses).Error
 	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
 		return nil, err
 	}
 
+	addressesById := map[int64][]ent.Address{}
+	for _, a := range addresses {
+		addressesById[a.EmailId] = append(addressesById[a.EmailId], a)
+	}
+
+	var contents []ent.EmailContent
+	tx := s.db.Select("email_id, size, relationship").Model(&ent.EmailContent{}).
+		Where(
+			"email_id IN ? and relationship in ?",
+			ids,
+			[]ent.RelType{ent.RelRaw, ent.RelHTML, ent.RelText},
+		).Find(&contents)
+
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+
+	contentsById := map[int64][]ent.EmailContent{}
+	for _, c := range contents {
+		contentsById[c.EmailId] = append(contentsById[c.EmailId], c)
+	}
+
+	var childCounts []struct {
+		ParentId int64
+		Count    int64
+	}
+	tx = s.db.Model(&ent.Email{}).
+		Select("parent_id, count(*) AS count").
+		Where("parent_id IN ?", ids).
+		Group("parent_id").
+		Scan(&childCounts)
+
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+
+	childCountsById := map[int64]int64{}
+	for _, c := range childCounts {
+		childCountsById[c.ParentId] = c.Count
+	}
+
+	result := make([]Message, len(emails))
+	for i := range emails {
+		email := &emails[i]
+		result[i] = *buildMessage(
+			email,
+			addressesById[email.Id],
+			contentsById[email.Id],
+			childCountsById[email.Id],
+		)
+	}
+
+	return result, nil
+}
+
+func buildMessage(
+	email *ent.Email,
+	recipients []ent.Address,
+	content []ent.EmailContent,
+	childCount int64,
+) *Message {
 	msgAddresses := map[string][]MailAddress{
 		"from": make([]MailAddress, 0),
 		"to":   make([]MailAddress, 0),
@@ -54,19 +140,8 @@ func (s *Server) buildMessageResponse(email *ent.Email) (*Message, error) {
 		toName = &msgAddresses["to"][0].Name
 	}
 
-	var content []ent.EmailContent
-	tx := s.db.Select("size, relationship").Model(&ent.EmailContent{}).
-		Where(
-			"email_id = ? and relationship in ?",
-			email.Id,
-			[]ent.RelType{ent.RelRaw, ent.RelHTML, ent.RelText},
-		).Find(&content)
-
-	if tx.Error != nil {
-		return nil, tx.Error
-	}
-
 	var emailSize, htmlBodySize, textBodySize int
+	var hasTextPart bool
 	for _, c := range content {
 		if c.Relationship == ent.RelRaw {
 			emailSize = c.Size
@@ -74,10 +149,11 @@ func (s *Server) buildMessageResponse(email *ent.Email) (*Message, error) {
 			htmlBodySize = c.Size
 		} else if c.Relationship == ent.RelText {
 			textBodySize = c.Size
+			hasTextPart = true
 		}
 	}
 
-	result := Message{
+	return &Message{
 		Id:           email.Id,
 		InboxId:      email.InboxId,
 		Subject:      email.Subject,
@@ -94,6 +170,7 @@ func (s *Server) buildMessageResponse(email *ent.Email) (*Message, error) {
 		HTMLBodySize: htmlBodySize,
 		TextBodySize: textBodySize,
 		HumanSize:    humanize.Bytes(uint64(emailSize)),
+		ParentId:     email.ParentId,
 		SmtpInfo: MessageSmtpInfo{
 			Ok: true,
 			Data: MessageSmtpInfoData{
@@ -101,15 +178,32 @@ func (s *Server) buildMessageResponse(email *ent.Email) (*Message, error) {
 				ClientIP:     email.ClientIP,
 			},
 		},
+		EmbeddedMessagesCount: childCount,
+		HasTextPart:           hasTextPart,
+		Security:              buildSecurityResponse(email),
 	}
+}
 
-	return &result, nil
+func buildSecurityResponse(email *ent.Email) *MessageSecurity {
+	if email.Security == "" {
+		return nil
+	}
+
+	return &MessageSecurity{
+		Protocol:   email.Security,
+		Signed:     email.Signature != "",
+		Signature:  nullIfEmpty(email.Signature),
+		Signer:     nullIfEmpty(email.Signer),
+		Encrypted:  email.Encryption != "",
+		Encryption: nullIfEmpty(email.Encryption),
+		Error:      nullIfEmpty(email.SecurityError),
+	}
 }
 
 func (s *Server) buildInboxResponse(inbox *ent.Inbox) (*Inbox, error) {
 	var count int64
 	tx := s.db.Select("count(*)").Model(&ent.Email{}).
-		Where("inbox_id = ?", inbox.Id).
+		Where("inbox_id = ? and parent_id is null", inbox.Id).
 		Count(&count)
 
 	if tx.Error != nil {
@@ -118,7 +212,7 @@ func (s *Server) buildInboxResponse(inbox *ent.Inbox) (*Inbox, error) {
 
 	var unreadCount int64
 	tx = s.db.Select("count(*)").Model(&ent.Email{}).
-		Where("inbox_id = ? and is_read = ?", inbox.Id, false).
+		Where("inbox_id = ? and parent_id is null and is_read = ?", inbox.Id, false).
 		Count(&unreadCount)
 
 	if tx.Error != nil && !errors.Is(tx.Error, gorm.ErrRecordNotFound) {
@@ -126,7 +220,7 @@ func (s *Server) buildInboxResponse(inbox *ent.Inbox) (*Inbox, error) {
 	}
 
 	var lastSent ent.Email
-	tx = s.db.Model(&ent.Email{}).Where("inbox_id = ?", inbox.Id).
+	tx = s.db.Model(&ent.Email{}).Where("inbox_id = ? and parent_id is null", inbox.Id).
 		Order("created_at desc").First(&lastSent)
 
 	if tx.Error != nil && !errors.Is(tx.Error, gorm.ErrRecordNotFound) {
@@ -139,6 +233,12 @@ func (s *Server) buildInboxResponse(inbox *ent.Inbox) (*Inbox, error) {
 		lastSentTs = &s
 	}
 
+	var expiresAt *string
+	if inbox.ExpiresAt != nil {
+		s := inbox.ExpiresAt.UTC().Format(timestampFormat)
+		expiresAt = &s
+	}
+
 	result := Inbox{
 		Id:                   inbox.Id,
 		Name:                 inbox.Name,
@@ -150,11 +250,33 @@ func (s *Server) buildInboxResponse(inbox *ent.Inbox) (*Inbox, error) {
 		EmailsCount:          count,
 		EmailsUnreadCount:    unreadCount,
 		LastMessageSentAt:    lastSentTs,
+		ExpiresAt:            expiresAt,
+		AccountId:            inbox.AccountId,
 	}
 
 	return &result, nil
 }
 
+// buildInboxListResponse builds the responses of a list of inboxes, leaving
+// out the expired ones.
+func (s *Server) buildInboxListResponse(inboxes []ent.Inbox) ([]Inbox, error) {
+	result := make([]Inbox, 0, len(inboxes))
+	for _, inbox := range inboxes {
+		if inbox.Expired() {
+			continue
+		}
+
+		msg, err := s.buildInboxResponse(&inbox)
+		if err != nil {
+			return nil, fmt.Errorf("inbox %d: %s", inbox.Id, err)
+		}
+
+		result = append(result, *msg)
+	}
+
+	return result, nil
+}
+
 func (s *Server) buildAttachmentResponse(email *ent.Email, attach *ent.EmailContent) (*Attachment, error) {
 	var attachType string
 	switch attach.Relationship {
@@ -177,6 +299,7 @@ func (s *Server) buildAttachmentResponse(email *ent.Email, attach *ent.EmailCont
 		Filename:       filename,
 		AttachmentType: attachType,
 		ContentType:    attach.MimeType,
+		ContentID:      nullIfEmpty(attach.ContentId),
 		AttachmentSize: attach.Size,
 		HumanSize:      humanize.Bytes(uint64(attach.Size)),
 		CreatedAt:      email.CreatedAt.UTC().Format(timestampFormat),
@@ -185,3 +308,238 @@ func (s *Server) buildAttachmentResponse(email *ent.Email, attach *ent.EmailCont
 
 	return &result, nil
 }
+
+func buildDeliveryResponse(delivery *ent.Delivery) *Delivery {
+	var deliveryErr *string
+	if delivery.Error != "" {
+		deliveryErr = &delivery.Error
+	}
+
+	return &Delivery{
+		Id:        delivery.Id,
+		MessageId: delivery.EmailId,
+		RuleId:    delivery.RuleId,
+		Recipient: delivery.Recipient,
+		Status:    string(delivery.Status),
+		Error:     deliveryErr,
+		CreatedAt: delivery.CreatedAt.UTC().Format(timestampFormat),
+	}
+}
+
+func buildCalendarEventResponse(event *ent.CalendarEvent) (*CalendarEvent, error) {
+	var attendees []ent.CalendarAttendee
+	if err := json.Unmarshal(event.AttendeesJson, &attendees); err != nil {
+		return nil, err
+	}
+
+	result := CalendarEvent{
+		Id:           event.Id,
+		MessageId:    event.EmailId,
+		Method:       nullIfEmpty(event.Method),
+		Uid:          event.Uid,
+		Sequence:     event.Sequence,
+		RecurrenceId: nullIfEmpty(event.RecurrenceId),
+		Summary:      nullIfEmpty(event.Summary),
+		Description:  nullIfEmpty(event.Description),
+		Location:     nullIfEmpty(event.Location),
+		Status:       nullIfEmpty(event.Status),
+		Attendees:    make([]CalendarAttendee, len(attendees)),
+		AllDay:       event.AllDay,
+		TimeZone:     nullIfEmpty(event.TimeZone),
+		RRule:        nullIfEmpty(event.RRule),
+	}
+
+	for i, a := range attendees {
+		result.Attendees[i] = CalendarAttendee{
+			Email:    a.Email,
+			Name:     nullIfEmpty(a.Name),
+			Role:     nullIfEmpty(a.Role),
+			PartStat: nullIfEmpty(a.PartStat),
+			RSVP:     a.RSVP,
+		}
+	}
+
+	if event.OrganizerEmail != "" {
+		result.Organizer = &CalendarAttendee{
+			Email: event.OrganizerEmail,
+			Name:  nullIfEmpty(event.OrganizerName),
+		}
+	}
+
+	if event.StartsAt != nil {
+		ts := event.StartsAt.UTC().Format(timestampFormat)
+		result.StartsAt = &ts
+	}
+
+	if event.EndsAt != nil {
+		ts := event.EndsAt.UTC().Format(timestampFormat)
+		result.EndsAt = &ts
+	}
+
+	return &result, nil
+}
+
+func buildForwardRuleResponse(rule *ent.ForwardRule) *ForwardRule {
+	return &ForwardRule{
+		Id:           rule.Id,
+		InboxId:      rule.InboxId,
+		Email:        rule.Recipient,
+		MatchFrom:    rule.MatchFrom,
+		MatchTo:      rule.MatchTo,
+		MatchSubject: rule.MatchSubject,
+		CreatedAt:    rule.CreatedAt.UTC().Format(timestampFormat),
+	}
+}
+
+func buildSessionResponse(session *ent.Session, user *ent.User) *Session {
+	return &Session{
+		Username:  user.Username,
+		InboxId:   session.InboxId,
+		CsrfToken: session.CsrfToken,
+		ExpiresAt: session.ExpiresAt.UTC().Format(timestampFormat),
+	}
+}
+
+// accountOwnerAccess is the Mailtrap access level of an account owner.
+const accountOwnerAccess = 1000
+
+func buildAccountResponse(account *ent.Account) *Account {
+	return &Account{
+		Id:           account.Id,
+		Name:         account.Name,
+		AccessLevels: []int{accountOwnerAccess},
+	}
+}
+
+func buildWebhookResponse(hook *ent.Webhook) *Webhook {
+	return &Webhook{
+		Id:        hook.Id,
+		InboxId:   hook.InboxId,
+		URL:       hook.URL,
+		CreatedAt: hook.CreatedAt.UTC().Format(timestampFormat),
+	}
+}
+
+func buildWebhookDeliveryResponse(delivery *ent.WebhookDelivery) *WebhookDelivery {
+	var statusCode *int
+	if delivery.StatusCode != 0 {
+		statusCode = &delivery.StatusCode
+	}
+
+	var deliveryErr *string
+	if delivery.Error != "" {
+		deliveryErr = &delivery.Error
+	}
+
+	return &WebhookDelivery{
+		Id:         delivery.Id,
+		WebhookId:  delivery.WebhookId,
+		MessageId:  delivery.EmailId,
+		Attempt:    delivery.Attempt,
+		Status:     string(delivery.Status),
+		StatusCode: statusCode,
+		Error:      deliveryErr,
+		CreatedAt:  delivery.CreatedAt.UTC().Format(timestampFormat),
+	}
+}
+
+func buildCodePatternResponse(pattern *ent.CodePattern) *CodePattern {
+	return &CodePattern{
+		Id:        pattern.Id,
+		InboxId:   pattern.InboxId,
+		Pattern:   pattern.Pattern,
+		CreatedAt: pattern.CreatedAt.UTC().Format(timestampFormat),
+	}
+}
+
+// contentType returns the Content-Type to serve stored content with. The text
+// and HTML bodies have been converted to UTF-8, while attachments are served
+// in their original charset.
+func contentType(content *ent.EmailContent) string {
+	switch {
+	case content.Relationship == ent.RelText || content.Relationship == ent.RelHTML ||
+		content.Relationship == ent.RelHTMLText:
+		return content.MimeType + "; charset=utf-8"
+	case content.Charset != "":
+		ct := mime.FormatMediaType(content.MimeType, map[string]string{"charset": content.Charset})
+		if ct != "" {
+			return ct
+		}
+	}
+
+	return content.MimeType
+}
+
+// contentDisposition returns an attachment Content-Disposition as described in
+// RFC 6266, with an ASCII fallback for clients that don't support filename*.
+func contentDisposition(filename string) string {
+	if filename == "" {
+		return "attachment"
+	}
+
+	var fallback, encoded strings.Builder
+	for _, r := range filename {
+		switch {
+		case r == '"' || r == '\\':
+			fallback.WriteByte('\\')
+			fallback.WriteRune(r)
+		case r < 0x20 || r > 0x7e:
+			fallback.WriteByte('_')
+		default:
+			fallback.WriteRune(r)
+		}
+	}
+
+	for _, b := range []byte(filename) {
+		if isAttrChar(b) {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+
+	return fmt.Sprintf("attachment; filename=\"%s\"; filename*=UTF-8''%s", fallback.String(), encoded.String())
+}
+
+// isAttrChar reports whether b can appear unencoded in an RFC 5987 value.
+func isAttrChar(b byte) bool {
+	switch {
+	case b >= 'a' && b <= 'z', b >= 'A' && b <= 'Z', b >= '0' && b <= '9':
+		return true
+	}
+
+	return strings.IndexByte("!#$&+-.^_`|~", b) >= 0
+}
+
+func nullIfEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+
+	return &s
+}
+
+func buildPartResponse(part *parsemail.Part) *MessagePart {
+	result := MessagePart{
+		Path:             part.Path,
+		ContentType:      part.ContentType,
+		Params:           part.Params,
+		Charset:          nullIfEmpty(part.Charset),
+		TransferEncoding: nullIfEmpty(part.TransferEncoding),
+		Disposition:      nullIfEmpty(part.Disposition),
+		Filename:         nullIfEmpty(part.Filename),
+		ContentID:        nullIfEmpty(part.ContentID),
+		Headers:          part.Header,
+		Offset:           part.Offset,
+		BodyOffset:       part.BodyOffset,
+		End:              part.End,
+		Size:             part.End - part.BodyOffset,
+		Parts:            make([]MessagePart, len(part.Parts)),
+	}
+
+	for i, child := range part.Parts {
+		result.Parts[i] = *buildPartResponse(child)
+	}
+
+	return &result
+}
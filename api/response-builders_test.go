@@ -0,0 +1,118 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	ent "github.com/supriyo-biswas/postbox/entities"
+	"github.com/supriyo-biswas/postbox/utils"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const (
+	benchApiKey    = "bench-api-key"
+	benchEmails    = 100
+	benchPageSize  = 30
+	benchQueryName = "bench:count_queries"
+)
+
+// openBenchDb returns a database with an inbox of benchEmails emails, each
+// with a sender, a recipient, a raw source and a text body, and a counter of
+// the queries run on it.
+func openBenchDb(b *testing.B) (*gorm.DB, *ent.Inbox, *atomic.Int64) {
+	b.Helper()
+
+	dbPath := filepath.Join(b.TempDir(), "db.sqlite3")
+	db, err := gorm.Open(sqlite.Open(dbPath+"?_journal_mode=WAL&_foreign_keys=true"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		b.Fatalf("failed to open database: %s", err)
+	}
+
+	err = db.AutoMigrate(&ent.Inbox{}, &ent.Email{}, &ent.Address{}, &ent.EmailContent{})
+	if err != nil {
+		b.Fatalf("failed to migrate database: %s", err)
+	}
+
+	inbox := ent.Inbox{Name: "bench", SmtpPass: "bench", ApiKey: utils.HashSecret(benchApiKey)}
+	if err := db.Create(&inbox).Error; err != nil {
+		b.Fatalf("failed to create inbox: %s", err)
+	}
+
+	for i := range benchEmails {
+		raw := fmt.Sprintf("From: sender%d@example.com\r\nSubject: Message %d\r\n\r\nHello\r\n", i, i)
+		email := ent.Email{
+			InboxId:     inbox.Id,
+			ClientIP:    "127.0.0.1:25",
+			MailFrom:    fmt.Sprintf("sender%d@example.com", i),
+			Subject:     fmt.Sprintf("Message %d", i),
+			HeadersJson: []byte("{}"),
+			Addresses: []ent.Address{
+				{Type: ent.FromAddr, Address: fmt.Sprintf("sender%d@example.com", i), Name: "Sender"},
+				{Type: ent.ToAddr, Address: "rcpt@example.com", Name: "Recipient"},
+			},
+			Contents: []ent.EmailContent{
+				{Relationship: ent.RelRaw, Content: []byte(raw), MimeType: "message/rfc822", Size: len(raw)},
+				{Relationship: ent.RelText, Content: []byte("Hello"), MimeType: "text/plain", Size: 5},
+			},
+		}
+
+		if err := db.Create(&email).Error; err != nil {
+			b.Fatalf("failed to create email: %s", err)
+		}
+	}
+
+	var queries atomic.Int64
+	count := func(*gorm.DB) { queries.Add(1) }
+	db.Callback().Query().After("gorm:query").Register(benchQueryName, count)
+	db.Callback().Row().After("gorm:row").Register(benchQueryName, count)
+
+	return db, &inbox, &queries
+}
+
+func BenchmarkBuildMessageResponses(b *testing.B) {
+	db, inbox, queries := openBenchDb(b)
+	s := NewServer(db)
+
+	var emails []ent.Email
+	if err := db.Where("inbox_id = ?", inbox.Id).Order("id DESC").Limit(benchPageSize).Find(&emails).Error; err != nil {
+		b.Fatalf("failed to get emails: %s", err)
+	}
+
+	queries.Store(0)
+	for b.Loop() {
+		if _, err := s.buildMessageResponses(emails); err != nil {
+			b.Fatalf("failed to build responses: %s", err)
+		}
+	}
+
+	b.ReportMetric(float64(queries.Load())/float64(b.N), "queries/op")
+}
+
+func BenchmarkListInboxMessages(b *testing.B) {
+	db, inbox, queries := openBenchDb(b)
+	s := NewServer(db)
+
+	url := fmt.Sprintf("/api/v1/inboxes/%d/messages?page=1&size=%d", inbox.Id, benchPageSize)
+
+	queries.Store(0)
+	for b.Loop() {
+		req := httptest.NewRequest("GET", url, nil)
+		req.Header.Set("Api-Token", benchApiKey)
+		w := httptest.NewRecorder()
+
+		s.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			b.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	b.ReportMetric(float64(queries.Load())/float64(b.N), "queries/op")
+}
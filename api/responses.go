@@ -9,20 +9,60 @@ import (
 const timestampFormat = "2006-01-02T15:04:05.000Z"
 
 const (
-	attachmentNotFoundMsg  = "attachment not found"
-	basicAuthFailedMsg     = "invalid username or password for basic auth"
-	inboxNameMissingMsg    = "missing inbox name"
-	inboxNotFoundMsg       = "inbox not found"
-	internalServerErrorMsg = "an internal error occurred"
-	invalidApiKeyMsg       = "invalid API key"
-	invalidAttachmentIdMsg = "invalid attachment id"
-	invalidMessageIdMsg    = "invalid message id"
-	invalidRequestMsg      = "invalid request"
-	messageNotFoundMsg     = "message not found"
-	missingAuthTokenMsg    = "missing auth token"
-	unknownAuthTypeMsg     = "unknown auth type"
+	accountNotFoundMsg      = "account not found"
+	adminApiDisabledMsg     = "admin API is not enabled"
+	apiKeyScopeMsg          = "API key does not allow this request"
+	attachmentNotFoundMsg   = "attachment not found"
+	basicAuthFailedMsg      = "invalid username or password for basic auth"
+	codePatternNotFoundMsg  = "code pattern not found"
+	eventsNotConfiguredMsg  = "events are not configured"
+	inboxExistsMsg          = "inbox already exists"
+	inboxNameMissingMsg     = "missing inbox name"
+	inboxNotFoundMsg        = "inbox not found"
+	forwardFailedMsg        = "failed to forward message"
+	forwardRuleNotFoundMsg  = "forward rule not found"
+	internalServerErrorMsg  = "an internal error occurred"
+	invalidAccountIdMsg     = "invalid account id"
+	invalidAccountTokenMsg  = "invalid account token"
+	invalidAdminTokenMsg    = "invalid admin token"
+	invalidApiKeyMsg        = "invalid API key"
+	invalidAttachmentIdMsg  = "invalid attachment id"
+	invalidCodePatternIdMsg = "invalid code pattern id"
+	invalidCredentialsMsg   = "invalid username or password"
+	invalidCsrfTokenMsg     = "invalid CSRF token"
+	invalidMessageIdMsg     = "invalid message id"
+	invalidOidcStateMsg     = "invalid or expired login attempt"
+	invalidPatternMsg       = "invalid match pattern"
+	invalidRecipientMsg     = "invalid recipient address"
+	invalidRequestMsg       = "invalid request"
+	invalidRuleIdMsg        = "invalid forward rule id"
+	invalidSearchMsg        = "invalid search query"
+	invalidTtlMsg           = "invalid inbox TTL"
+	invalidWebhookIdMsg     = "invalid webhook id"
+	invalidWebhookUrlMsg    = "invalid webhook URL"
+	messageNotFoundMsg      = "message not found"
+	messageParseFailedMsg   = "failed to parse message"
+	partNotFoundMsg         = "part not found"
+	missingAuthTokenMsg     = "missing auth token"
+	noInboxSelectedMsg      = "no inbox selected"
+	notLoggedInMsg          = "not logged in"
+	oidcLoginFailedMsg      = "single sign-on login failed"
+	oidcNotConfiguredMsg    = "single sign-on is not configured"
+	oidcProviderErrorMsg    = "failed to contact the identity provider"
+	oidcUserExistsMsg       = "a user with the same username already exists"
+	relayNotConfiguredMsg   = "relay is not configured"
+	roleForbiddenMsg        = "your role in the inbox does not allow this request"
+	unknownAuthTypeMsg      = "unknown auth type"
+	waitTimeoutMsg          = "timed out waiting for a message"
+	webhookNotFoundMsg      = "webhook not found"
 )
 
+type Account struct {
+	Id           int64  `json:"id"`
+	Name         string `json:"name"`
+	AccessLevels []int  `json:"access_levels"`
+}
+
 type Inbox struct {
 	Id                   int64   `json:"id"`
 	Name                 string  `json:"name"`
@@ -34,6 +74,33 @@ type Inbox struct {
 	EmailsCount          int64   `json:"emails_count"`
 	EmailsUnreadCount    int64   `json:"emails_unread_count"`
 	LastMessageSentAt    *string `json:"last_message_sent_at"`
+	ExpiresAt            *string `json:"expires_at"`
+	AccountId            *int64  `json:"account_id"`
+}
+
+// InboxCredentials is returned when the credentials of an inbox are
+// generated, which is the only time they are available.
+type InboxCredentials struct {
+	Inbox
+	SmtpUsername string `json:"smtp_username"`
+	SmtpPassword string `json:"smtp_password"`
+	ApiKey       string `json:"api_key"`
+}
+
+type UserInbox struct {
+	Inbox
+	Role string `json:"role"`
+}
+
+type LoginOptions struct {
+	Oidc bool `json:"oidc"`
+}
+
+type Session struct {
+	Username  string `json:"username"`
+	InboxId   *int64 `json:"inbox_id"`
+	CsrfToken string `json:"csrf_token"`
+	ExpiresAt string `json:"expires_at"`
 }
 
 type MailAddress struct {
@@ -71,6 +138,33 @@ type Message struct {
 
 	// custom extension that provides a parsed list of all recipients
 	Addresses map[string][]MailAddress `json:"addresses"`
+
+	// custom extensions that link messages embedded as message/rfc822 parts
+	// to the message containing them
+	ParentId              *int64 `json:"parent_id"`
+	EmbeddedMessagesCount int64  `json:"embedded_messages_count"`
+
+	// custom extension that reports whether the sender supplied a text body,
+	// since body.txt falls back to a rendering of the HTML body
+	HasTextPart bool `json:"has_text_part"`
+
+	// custom extension with the outcome of verifying and decrypting S/MIME
+	// and PGP/MIME messages
+	Security *MessageSecurity `json:"security"`
+
+	// custom extension with the text that matched a full-text search, which
+	// is only present in search results
+	Snippet *string `json:"snippet,omitempty"`
+}
+
+type MessageSecurity struct {
+	Protocol   string  `json:"protocol"`
+	Signed     bool    `json:"signed"`
+	Signature  *string `json:"signature_status"`
+	Signer     *string `json:"signer"`
+	Encrypted  bool    `json:"encrypted"`
+	Encryption *string `json:"encryption_status"`
+	Error      *string `json:"error"`
 }
 
 type MessageHeaders struct {
@@ -87,13 +181,131 @@ type Attachment struct {
 	Filename       *string `json:"filename"`
 	AttachmentType string  `json:"attachment_type"`
 	ContentType    string  `json:"content_type"`
-	ContentID      any     `json:"content_id"`
+	ContentID      *string `json:"content_id"`
 	AttachmentSize int     `json:"attachment_size"`
 	CreatedAt      string  `json:"created_at"`
 	UpdatedAt      string  `json:"updated_at"`
 	HumanSize      string  `json:"attachment_human_size"`
 }
 
+type MessagePart struct {
+	Path             string              `json:"path"`
+	ContentType      string              `json:"content_type"`
+	Params           map[string]string   `json:"content_type_params"`
+	Charset          *string             `json:"charset"`
+	TransferEncoding *string             `json:"transfer_encoding"`
+	Disposition      *string             `json:"disposition"`
+	Filename         *string             `json:"filename"`
+	ContentID        *string             `json:"content_id"`
+	Headers          map[string][]string `json:"headers"`
+	Offset           int                 `json:"offset"`
+	BodyOffset       int                 `json:"body_offset"`
+	End              int                 `json:"end"`
+	Size             int                 `json:"size"`
+	Parts            []MessagePart       `json:"parts"`
+}
+
+type ForwardResult struct {
+	Message  string   `json:"message"`
+	Delivery Delivery `json:"delivery"`
+}
+
+type Delivery struct {
+	Id        int64   `json:"id"`
+	MessageId int64   `json:"message_id"`
+	RuleId    *int64  `json:"rule_id"`
+	Recipient string  `json:"recipient"`
+	Status    string  `json:"status"`
+	Error     *string `json:"error"`
+	CreatedAt string  `json:"created_at"`
+}
+
+type CalendarAttendee struct {
+	Email    string  `json:"email"`
+	Name     *string `json:"name"`
+	Role     *string `json:"role"`
+	PartStat *string `json:"partstat"`
+	RSVP     bool    `json:"rsvp"`
+}
+
+type CalendarEvent struct {
+	Id           int64              `json:"id"`
+	MessageId    int64              `json:"message_id"`
+	Method       *string            `json:"method"`
+	Uid          string             `json:"uid"`
+	Sequence     int                `json:"sequence"`
+	RecurrenceId *string            `json:"recurrence_id"`
+	Summary      *string            `json:"summary"`
+	Description  *string            `json:"description"`
+	Location     *string            `json:"location"`
+	Status       *string            `json:"status"`
+	Organizer    *CalendarAttendee  `json:"organizer"`
+	Attendees    []CalendarAttendee `json:"attendees"`
+	StartsAt     *string            `json:"starts_at"`
+	EndsAt       *string            `json:"ends_at"`
+	AllDay       bool               `json:"all_day"`
+	TimeZone     *string            `json:"time_zone"`
+	RRule        *string            `json:"rrule"`
+}
+
+type ForwardRule struct {
+	Id           int64  `json:"id"`
+	InboxId      int64  `json:"inbox_id"`
+	Email        string `json:"email"`
+	MatchFrom    string `json:"match_from"`
+	MatchTo      string `json:"match_to"`
+	MatchSubject string `json:"match_subject"`
+	CreatedAt    string `json:"created_at"`
+}
+
+type Link struct {
+	URL    string  `json:"url"`
+	Text   *string `json:"text"`
+	Source string  `json:"source"`
+}
+
+type Code struct {
+	Code      string `json:"code"`
+	Source    string `json:"source"`
+	Context   string `json:"context"`
+	PatternId *int64 `json:"pattern_id"`
+}
+
+type CodePattern struct {
+	Id        int64  `json:"id"`
+	InboxId   int64  `json:"inbox_id"`
+	Pattern   string `json:"pattern"`
+	CreatedAt string `json:"created_at"`
+}
+
+type Webhook struct {
+	Id        int64  `json:"id"`
+	InboxId   int64  `json:"inbox_id"`
+	URL       string `json:"url"`
+	CreatedAt string `json:"created_at"`
+}
+
+type WebhookWithSecret struct {
+	Webhook
+	Secret string `json:"secret"`
+}
+
+type WebhookDelivery struct {
+	Id         int64   `json:"id"`
+	WebhookId  int64   `json:"webhook_id"`
+	MessageId  int64   `json:"message_id"`
+	Attempt    int     `json:"attempt"`
+	Status     string  `json:"status"`
+	StatusCode *int    `json:"status_code"`
+	Error      *string `json:"error"`
+	CreatedAt  string  `json:"created_at"`
+}
+
+type Event struct {
+	Type string `json:"type"`
+	Data any    `json:"data"`
+}
+
 type Error struct {
 	Message string `json:"message"`
 }
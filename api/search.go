@@ -0,0 +1,293 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	ent "github.com/supriyo-biswas/postbox/entities"
+	"github.com/supriyo-biswas/postbox/fts"
+	"gorm.io/gorm"
+)
+
+var (
+	searchSpecial = regexp.MustCompile(`[\s%_]+`)
+	headerNameRe  = regexp.MustCompile(`^[A-Za-z0-9!#$%&'*+.^_|~-]+$`)
+)
+
+// likeContains returns a LIKE pattern that matches text containing s, where
+// whitespace, % and _ in s match any sequence of characters.
+func likeContains(s string) string {
+	return "%" + searchSpecial.ReplaceAllString(s, "%") + "%"
+}
+
+// searchKeys are the keys that terms can have. Any other text before a colon
+// is part of the term's value, so that searches like `Re: hello` or
+// `http://example.com` work.
+var searchKeys = []string{
+	"subject", "from", "to", "cc", "bcc", "has", "is", "after", "before",
+	"larger", "smaller", "header", "body",
+}
+
+// bodyRelationships are the contents that `body:` terms and terms without
+// a key are matched against when there is no full-text index.
+var bodyRelationships = []ent.RelType{ent.RelText, ent.RelHTML, ent.RelHTMLText}
+
+// searchTerm is one term of a search query, such as `-from:alice`. Terms
+// without a key match the subject, addresses and bodies.
+type searchTerm struct {
+	negate bool
+	key    string
+	value  string
+}
+
+// parseSearch splits a search query into terms. Terms are separated by
+// whitespace, unless it is inside double quotes, which can quote either the
+// whole term or just its value.
+func parseSearch(q string) ([]searchTerm, error) {
+	var terms []searchTerm
+	var cur strings.Builder
+	inQuotes, quoted := false, false
+
+	flush := func() {
+		if cur.Len() == 0 && !quoted {
+			return
+		}
+
+		raw := cur.String()
+		t := searchTerm{}
+		if strings.HasPrefix(raw, "-") && len(raw) > 1 {
+			t.negate = true
+			raw = raw[1:]
+		}
+
+		if i := strings.Index(raw, ":"); i > 0 && slices.Contains(searchKeys, strings.ToLower(raw[:i])) {
+			t.key = strings.ToLower(raw[:i])
+			raw = raw[i+1:]
+		}
+
+		t.value = strings.ReplaceAll(raw, "\"", "")
+		terms = append(terms, t)
+		cur.Reset()
+		quoted = false
+	}
+
+	for _, r := range q {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			quoted = true
+			cur.WriteRune(r)
+		case !inQuotes && (r == ' ' || r == '\t' || r == '\n' || r == '\r'):
+			flush()
+		default:
+			cur.WriteRune(r)
+		}
+	}
+
+	if inQuotes {
+		return nil, errors.New("unterminated quote")
+	}
+
+	flush()
+	return terms, nil
+}
+
+func parseSearchTime(v string) (time.Time, error) {
+	if t, err := time.Parse(time.DateOnly, v); err == nil {
+		return t, nil
+	}
+
+	return time.Parse(time.RFC3339Nano, v)
+}
+
+func addressCondition(types []ent.AddressType, value string) (string, []any) {
+	if value == "" {
+		return "id IN (SELECT email_id FROM addresses WHERE type IN ?)", []any{types}
+	}
+
+	pattern := likeContains(value)
+	return "id IN (SELECT email_id FROM addresses WHERE type IN ? AND (address LIKE ? OR name LIKE ?))",
+		[]any{types, pattern, pattern}
+}
+
+// textCondition returns a condition that matches emails with each word of
+// s in their subject, addresses or bodies, or only in their bodies if
+// bodyOnly is set. It is used in place of the full-text index, and matches
+// the same fields.
+func textCondition(s string, bodyOnly bool) (string, []any) {
+	words := strings.Fields(s)
+	if len(words) == 0 {
+		words = []string{s}
+	}
+
+	conds := make([]string, len(words))
+	var args []any
+	for i, word := range words {
+		pattern := likeContains(word)
+		cond := "id IN (SELECT email_id FROM email_contents WHERE relationship IN ? AND CAST(content AS TEXT) LIKE ?)"
+		if bodyOnly {
+			args = append(args, bodyRelationships, pattern)
+		} else {
+			cond = "subject LIKE ? OR id IN (SELECT email_id FROM addresses WHERE address LIKE ? OR name LIKE ?) OR " + cond
+			args = append(args, pattern, pattern, pattern, bodyRelationships, pattern)
+		}
+		conds[i] = "(" + cond + ")"
+	}
+
+	return "(" + strings.Join(conds, " AND ") + ")", args
+}
+
+// search translates search queries into conditions on the emails table.
+// Terms without a key and `body:` terms use the full-text index if there is
+// one, and textCondition otherwise.
+type search struct {
+	index *fts.Index
+
+	// matches has the FTS5 queries of the terms that use the index and
+	// aren't negated, which are used to rank the results
+	matches []string
+}
+
+// indexCondition returns the condition for a term that uses the full-text
+// index, or an empty string if the term has no words that can be indexed.
+func (s *search) indexCondition(t searchTerm, query string) (string, []any) {
+	if s.index == nil || query == "" {
+		return "", nil
+	}
+
+	if !t.negate {
+		s.matches = append(s.matches, query)
+	}
+
+	return s.index.Match(query)
+}
+
+// condition returns the SQL condition on the emails table for a term.
+func (s *search) condition(t searchTerm) (string, []any, error) {
+	switch t.key {
+	case "":
+		if cond, args := s.indexCondition(t, fts.Query(t.value)); cond != "" {
+			return cond, args, nil
+		}
+		cond, args := textCondition(t.value, false)
+		return cond, args, nil
+
+	case "subject":
+		if t.value == "" {
+			break
+		}
+		return "subject LIKE ?", []any{likeContains(t.value)}, nil
+
+	case "from":
+		cond, args := addressCondition([]ent.AddressType{ent.FromAddr}, t.value)
+		return cond, args, nil
+
+	case "to":
+		cond, args := addressCondition([]ent.AddressType{ent.ToAddr}, t.value)
+		return cond, args, nil
+
+	case "cc":
+		cond, args := addressCondition([]ent.AddressType{ent.CcAddr}, t.value)
+		return cond, args, nil
+
+	case "bcc":
+		cond, args := addressCondition([]ent.AddressType{ent.BccAddr}, t.value)
+		return cond, args, nil
+
+	case "has":
+		if strings.ToLower(t.value) != "attachment" {
+			break
+		}
+		return "id IN (SELECT email_id FROM email_contents WHERE relationship = ?)",
+			[]any{ent.RelAttach}, nil
+
+	case "is":
+		switch strings.ToLower(t.value) {
+		case "read":
+			return "is_read = ?", []any{true}, nil
+		case "unread":
+			return "is_read = ?", []any{false}, nil
+		}
+
+	case "after", "before":
+		v, err := parseSearchTime(t.value)
+		if err != nil {
+			break
+		}
+		if t.key == "after" {
+			return "created_at >= ?", []any{v.Local()}, nil
+		}
+		return "created_at < ?", []any{v.Local()}, nil
+
+	case "larger", "smaller":
+		size, err := humanize.ParseBytes(t.value)
+		if err != nil {
+			break
+		}
+		op := ">"
+		if t.key == "smaller" {
+			op = "<"
+		}
+		return "id IN (SELECT email_id FROM email_contents WHERE relationship = ? AND size " + op + " ?)",
+			[]any{ent.RelRaw, size}, nil
+
+	case "header":
+		name, value, hasValue := strings.Cut(t.value, "=")
+		if !headerNameRe.MatchString(name) {
+			break
+		}
+
+		// headers are saved as a JSON object of canonical header names to
+		// lists of values
+		path := fmt.Sprintf(`$."%s"`, textproto.CanonicalMIMEHeaderKey(name))
+		if !hasValue {
+			return "EXISTS (SELECT 1 FROM json_each(CAST(emails.headers_json AS TEXT), ?))",
+				[]any{path}, nil
+		}
+		return "EXISTS (SELECT 1 FROM json_each(CAST(emails.headers_json AS TEXT), ?) WHERE value LIKE ?)",
+			[]any{path, likeContains(value)}, nil
+
+	case "body":
+		if t.value == "" {
+			break
+		}
+		if cond, args := s.indexCondition(t, fts.BodyQuery(t.value)); cond != "" {
+			return cond, args, nil
+		}
+		cond, args := textCondition(t.value, true)
+		return cond, args, nil
+	}
+
+	return "", nil, fmt.Errorf("invalid search term %s:%s", t.key, t.value)
+}
+
+// apply filters a query on the emails table by a search query. It returns an
+// FTS5 query to rank the results by, which is empty unless the search used
+// the full-text index.
+func (s *search) apply(tx *gorm.DB, q string) (*gorm.DB, string, error) {
+	terms, err := parseSearch(q)
+	if err != nil {
+		return nil, "", err
+	}
+
+	for _, t := range terms {
+		cond, args, err := s.condition(t)
+		if err != nil {
+			return nil, "", err
+		}
+
+		if t.negate {
+			tx = tx.Not(cond, args...)
+		} else {
+			tx = tx.Where(cond, args...)
+		}
+	}
+
+	return tx, strings.Join(s.matches, " AND "), nil
+}
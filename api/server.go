@@ -5,6 +5,9 @@ import (
 	"net/http"
 
 	"github.com/gorilla/mux"
+	"github.com/supriyo-biswas/postbox/fts"
+	"github.com/supriyo-biswas/postbox/hub"
+	"github.com/supriyo-biswas/postbox/relay"
 	"github.com/sym01/htmlsanitizer"
 	"gorm.io/gorm"
 )
@@ -16,12 +19,44 @@ type Server struct {
 	router    *mux.Router
 	fs        http.FileSystem
 	sanitizer *htmlsanitizer.HTMLSanitizer
+	relay     *relay.Relay
+	hub       *hub.Hub
+	index     *fts.Index
+	oidc      *OidcLogin
+
+	adminToken string
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.router.ServeHTTP(w, r)
 }
 
+func (s *Server) SetRelay(r *relay.Relay) {
+	s.relay = r
+}
+
+func (s *Server) SetHub(h *hub.Hub) {
+	s.hub = h
+}
+
+func (s *Server) SetAdminToken(token string) {
+	s.adminToken = token
+}
+
+func (s *Server) SetSearchIndex(idx *fts.Index) {
+	s.index = idx
+}
+
+func (s *Server) SetOidc(o *OidcLogin) {
+	s.oidc = o
+}
+
+func (s *Server) publish(e hub.Event) {
+	if s.hub != nil {
+		s.hub.Publish(e)
+	}
+}
+
 func NewServer(db *gorm.DB) *Server {
 	r := mux.NewRouter()
 	s := &Server{
@@ -43,15 +78,43 @@ func NewServer(db *gorm.DB) *Server {
 	}
 
 	web := r.PathPrefix("/web").Subrouter()
+	web.HandleFunc("/api/login", s.getLoginOptions).Methods("GET")
+	web.HandleFunc("/api/login", s.webLogin).Methods("POST")
+	web.HandleFunc("/api/oidc/login", s.oidcLogin).Methods("GET")
+	web.HandleFunc("/api/oidc/callback", s.oidcCallback).Methods("GET")
+
+	wuser := web.PathPrefix("/api").Subrouter()
+	wuser.Use(s.enforceSession)
+	wuser.HandleFunc("/logout", s.webLogout).Methods("POST")
+	wuser.HandleFunc("/session", s.getSession).Methods("GET")
+	wuser.HandleFunc("/session", s.updateSession).Methods("PATCH")
+	wuser.HandleFunc("/inboxes", s.listUserInboxes).Methods("GET")
+
 	wapi := web.PathPrefix("/api").Subrouter()
 	web.PathPrefix("").Handler(http.StripPrefix("/web", http.FileServer(s.fs)))
 
-	wapi.Use(s.enforceBasicAuth)
+	wapi.Use(s.enforceWebAuth)
 	wapi.HandleFunc("/info", s.webApiGetInfo).Methods("GET")
 
+	admin := r.PathPrefix("/api/admin").Subrouter()
+	admin.Use(s.enforceAdminToken)
+	admin.HandleFunc("/inboxes", s.adminListInboxes).Methods("GET")
+	admin.HandleFunc("/inboxes", s.adminCreateInbox).Methods("POST")
+
+	adminInbox := admin.PathPrefix("/inboxes/{inbox}").Subrouter()
+	adminInbox.Use(s.bindAdminInbox)
+	adminInbox.HandleFunc("", s.getInbox).Methods("GET")
+	adminInbox.HandleFunc("", s.adminUpdateInbox).Methods("PATCH")
+	adminInbox.HandleFunc("", s.adminDeleteInbox).Methods("DELETE")
+	adminInbox.HandleFunc("/rotate", s.adminRotateInbox).Methods("POST")
+	adminInbox.HandleFunc("/clean", s.cleanInbox).Methods("PATCH")
+
 	v1 := r.PathPrefix("/api/v1").Subrouter()
 	v2 := r.PathPrefix("/api/accounts/{account}").Subrouter()
 
+	r.Handle("/api/accounts", s.enforceAccountToken(http.HandlerFunc(s.listAccounts))).Methods("GET")
+	v2.Handle("/inboxes", s.enforceAccountToken(http.HandlerFunc(s.listAccountInboxes))).Methods("GET")
+
 	v1Inbox := v1.PathPrefix("/inboxes/{inbox}").Subrouter()
 	v2Inbox := v2.PathPrefix("/inboxes/{inbox}").Subrouter()
 
@@ -65,6 +128,18 @@ func NewServer(db *gorm.DB) *Server {
 		sr.HandleFunc("/clean", s.cleanInbox).Methods("PATCH")
 		sr.HandleFunc("/all_read", s.markReadInbox).Methods("PATCH")
 		sr.HandleFunc("/messages", s.listInboxMessages).Methods("GET")
+		sr.HandleFunc("/messages/wait", s.waitForMessage).Methods("GET")
+		sr.HandleFunc("/events", s.streamEvents).Methods("GET")
+		sr.HandleFunc("/forward_rules", s.listForwardRules).Methods("GET")
+		sr.HandleFunc("/forward_rules", s.createForwardRule).Methods("POST")
+		sr.HandleFunc("/forward_rules/{rule}", s.deleteForwardRule).Methods("DELETE")
+		sr.HandleFunc("/code_patterns", s.listCodePatterns).Methods("GET")
+		sr.HandleFunc("/code_patterns", s.createCodePattern).Methods("POST")
+		sr.HandleFunc("/code_patterns/{pattern}", s.deleteCodePattern).Methods("DELETE")
+		sr.HandleFunc("/webhooks", s.listWebhooks).Methods("GET")
+		sr.HandleFunc("/webhooks", s.createWebhook).Methods("POST")
+		sr.HandleFunc("/webhooks/{webhook}", s.deleteWebhook).Methods("DELETE")
+		sr.HandleFunc("/webhooks/{webhook}/deliveries", s.listWebhookDeliveries).Methods("GET")
 	}
 
 	v1Message := v1Inbox.PathPrefix("/messages/{message}").Subrouter()
@@ -78,12 +153,20 @@ func NewServer(db *gorm.DB) *Server {
 		sr.HandleFunc("", s.updateMessage).Methods("PATCH")
 		sr.HandleFunc("", s.deleteMessage).Methods("DELETE")
 		sr.HandleFunc("/headers", s.getMessageHeaders).Methods("GET")
+		sr.HandleFunc("/embedded_messages", s.listEmbeddedMessages).Methods("GET")
 		sr.HandleFunc("/body.txt", s.getTextBody).Methods("GET")
 		sr.HandleFunc("/body.html", s.getSanitizedHTMLBody).Methods("GET")
 		sr.HandleFunc("/body.htmlsource", s.getHTMLBody).Methods("GET")
 		sr.HandleFunc("/body.eml", s.getRawSource).Methods("GET")
 		sr.HandleFunc("/body.raw", s.getRawSource).Methods("GET")
 		sr.HandleFunc("/attachments", s.listAttachments).Methods("GET")
+		sr.HandleFunc("/calendar_events", s.listCalendarEvents).Methods("GET")
+		sr.HandleFunc("/links", s.listLinks).Methods("GET")
+		sr.HandleFunc("/codes", s.listCodes).Methods("GET")
+		sr.HandleFunc("/parts", s.getMessageParts).Methods("GET")
+		sr.HandleFunc("/parts/{path}/raw", s.getMessagePartRaw).Methods("GET")
+		sr.HandleFunc("/forward", s.forwardMessage).Methods("POST")
+		sr.HandleFunc("/forwards", s.listForwards).Methods("GET")
 	}
 
 	v1Attachment := v1Message.PathPrefix("/attachments/{attachment}").Subrouter()
@@ -0,0 +1,222 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	ent "github.com/supriyo-biswas/postbox/entities"
+	"github.com/supriyo-biswas/postbox/utils"
+	"gorm.io/gorm"
+)
+
+// dummyPasswordHash is verified against when logging in as a user that
+// doesn't exist, so that it takes as long as logging in with a wrong
+// password.
+var dummyPasswordHash = sync.OnceValue(func() string {
+	hash, err := utils.HashPassword("")
+	if err != nil {
+		log.Printf("failed to hash password: %s", err)
+	}
+	return hash
+})
+
+func setSessionCookie(w http.ResponseWriter, r *http.Request, token string, expires time.Time) {
+	c := &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/web",
+		Expires:  expires,
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+
+	if token == "" {
+		c.MaxAge = -1
+	}
+
+	http.SetCookie(w, c)
+}
+
+func (s *Server) sendSessionResponse(w http.ResponseWriter, session *ent.Session) {
+	var user ent.User
+	if err := s.db.First(&user, session.UserId).Error; err != nil {
+		log.Printf("failed to get user %d: %s", session.UserId, err)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	sendResponse(w, http.StatusOK, buildSessionResponse(session, &user))
+}
+
+// startSession logs a user in, and sets the session cookie.
+func (s *Server) startSession(w http.ResponseWriter, r *http.Request, user *ent.User) (*ent.Session, error) {
+	token, err := utils.RandomString(32)
+	if err != nil {
+		return nil, err
+	}
+
+	csrfToken, err := utils.RandomString(32)
+	if err != nil {
+		return nil, err
+	}
+
+	session := ent.Session{
+		UserId:    user.Id,
+		TokenHash: utils.HashSecret(token),
+		CsrfToken: csrfToken,
+		ExpiresAt: time.Now().Add(sessionLifetime),
+	}
+
+	// start with the first inbox the user is a member of
+	var inboxIds []int64
+	tx := s.db.Model(&ent.Membership{}).Where("user_id = ?", user.Id).Order("inbox_id").Limit(1).Pluck("inbox_id", &inboxIds)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+
+	if len(inboxIds) > 0 {
+		session.InboxId = &inboxIds[0]
+	}
+
+	if err := s.db.Create(&session).Error; err != nil {
+		return nil, err
+	}
+
+	setSessionCookie(w, r, token, session.ExpiresAt)
+	return &session, nil
+}
+
+func (s *Server) webLogin(w http.ResponseWriter, r *http.Request) {
+	var req Login
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, http.StatusBadRequest, invalidRequestMsg)
+		return
+	}
+
+	var user ent.User
+	tx := s.db.Where("username = ?", req.Username).First(&user)
+	found := tx.Error == nil
+	if tx.Error != nil && !errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+		log.Printf("failed to get user: %s", tx.Error)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	// users that log in with OIDC have no password
+	hash := user.PasswordHash
+	if !found || hash == "" {
+		hash = dummyPasswordHash()
+	}
+
+	ok, err := utils.VerifyPassword(req.Password, hash)
+	if err != nil {
+		log.Printf("failed to verify password for user %s: %s", req.Username, err)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	if !found || user.PasswordHash == "" || !ok {
+		sendError(w, http.StatusUnauthorized, invalidCredentialsMsg)
+		return
+	}
+
+	session, err := s.startSession(w, r, &user)
+	if err != nil {
+		log.Printf("failed to create session for user %d: %s", user.Id, err)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	sendResponse(w, http.StatusOK, buildSessionResponse(session, &user))
+}
+
+func (s *Server) webLogout(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(sessionContextKey).(*ent.Session)
+
+	if err := s.db.Delete(session).Error; err != nil {
+		log.Printf("failed to delete session %d: %s", session.Id, err)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	setSessionCookie(w, r, "", time.Unix(0, 0))
+	s.sendSessionResponse(w, session)
+}
+
+func (s *Server) getSession(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(sessionContextKey).(*ent.Session)
+	s.sendSessionResponse(w, session)
+}
+
+func (s *Server) updateSession(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(sessionContextKey).(*ent.Session)
+
+	var req UpdateSession
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.InboxId == nil {
+		sendError(w, http.StatusBadRequest, invalidRequestMsg)
+		return
+	}
+
+	inbox, _, err := s.findMemberInbox(session.UserId, *req.InboxId)
+	if err != nil {
+		log.Printf("failed to get inbox: %s", err)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	} else if inbox == nil {
+		sendError(w, http.StatusNotFound, inboxNotFoundMsg)
+		return
+	}
+
+	session.InboxId = &inbox.Id
+	if err := s.db.Model(session).Update("inbox_id", inbox.Id).Error; err != nil {
+		log.Printf("failed to update session %d: %s", session.Id, err)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	s.sendSessionResponse(w, session)
+}
+
+func (s *Server) listUserInboxes(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value(sessionContextKey).(*ent.Session)
+
+	var memberships []ent.Membership
+	if err := s.db.Where("user_id = ?", session.UserId).Find(&memberships).Error; err != nil {
+		log.Printf("failed to get inboxes of user %d: %s", session.UserId, err)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	ids := make([]int64, len(memberships))
+	roles := make(map[int64]ent.MembershipRole, len(memberships))
+	for i, m := range memberships {
+		ids[i] = m.InboxId
+		roles[m.InboxId] = m.Role
+	}
+
+	var inboxes []ent.Inbox
+	if err := s.db.Where("id IN ?", ids).Order("id").Find(&inboxes).Error; err != nil {
+		log.Printf("failed to get inboxes of user %d: %s", session.UserId, err)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	list, err := s.buildInboxListResponse(inboxes)
+	if err != nil {
+		log.Printf("failed to get inboxes: %s", err)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	result := make([]UserInbox, len(list))
+	for i, inbox := range list {
+		result[i] = UserInbox{Inbox: inbox, Role: string(roles[inbox.Id])}
+	}
+
+	sendResponse(w, http.StatusOK, result)
+}
@@ -0,0 +1,172 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	ent "github.com/supriyo-biswas/postbox/entities"
+	"github.com/supriyo-biswas/postbox/hub"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultWaitTimeout = 30 * time.Second
+	maxWaitTimeout     = 5 * time.Minute
+)
+
+// waitFilter selects the messages that waitForMessage returns. Messages must
+// be newer than both afterId and after, if they are set.
+type waitFilter struct {
+	to      string
+	from    string
+	subject string
+	after   time.Time
+	afterId int64
+}
+
+func parseWaitFilter(q url.Values) (*waitFilter, time.Duration, error) {
+	f := &waitFilter{
+		to:      strings.TrimSpace(q.Get("to")),
+		from:    strings.TrimSpace(q.Get("from")),
+		subject: strings.TrimSpace(q.Get("subject")),
+	}
+
+	if v := q.Get("after"); v != "" {
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return nil, 0, err
+		}
+		f.after = t
+	}
+
+	if v := q.Get("after_id"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, 0, err
+		}
+		f.afterId = id
+	}
+
+	timeout := defaultWaitTimeout
+	if v := q.Get("timeout"); v != "" {
+		secs, err := strconv.ParseFloat(v, 64)
+		if err != nil || secs < 0 {
+			return nil, 0, errors.New("invalid timeout")
+		}
+		timeout = min(time.Duration(secs*float64(time.Second)), maxWaitTimeout)
+	}
+
+	return f, timeout, nil
+}
+
+// find returns the matching message, or nil if there isn't one. When a
+// message id or timestamp to wait after is given, this is the oldest matching
+// message after it; otherwise, it is the most recent matching message.
+func (f *waitFilter) find(db *gorm.DB, inbox int64) (*ent.Email, error) {
+	tx := db.Where("inbox_id = ? AND parent_id IS NULL", inbox)
+
+	if f.afterId > 0 {
+		tx = tx.Where("id > ?", f.afterId)
+	}
+
+	if !f.after.IsZero() {
+		tx = tx.Where("created_at > ?", f.after.Local())
+	}
+
+	if f.subject != "" {
+		tx = tx.Where("subject LIKE ?", likeContains(f.subject))
+	}
+
+	if f.to != "" {
+		tx = tx.Where(
+			"id IN (SELECT email_id FROM addresses WHERE type IN ? AND address LIKE ?)",
+			[]ent.AddressType{ent.ToAddr, ent.CcAddr, ent.BccAddr},
+			likeContains(f.to),
+		)
+	}
+
+	if f.from != "" {
+		tx = tx.Where(
+			"id IN (SELECT email_id FROM addresses WHERE type = ? AND address LIKE ?)",
+			ent.FromAddr,
+			likeContains(f.from),
+		)
+	}
+
+	if f.afterId > 0 || !f.after.IsZero() {
+		tx = tx.Order("id")
+	} else {
+		tx = tx.Order("id DESC")
+	}
+
+	var emails []ent.Email
+	if err := tx.Limit(1).Find(&emails).Error; err != nil {
+		return nil, err
+	}
+
+	if len(emails) == 0 {
+		return nil, nil
+	}
+
+	return &emails[0], nil
+}
+
+func (s *Server) waitForMessage(w http.ResponseWriter, r *http.Request) {
+	inbox := r.Context().Value(inboxContextKey).(*ent.Inbox)
+
+	filter, timeout, err := parseWaitFilter(r.URL.Query())
+	if err != nil {
+		sendError(w, http.StatusBadRequest, invalidRequestMsg)
+		return
+	}
+
+	// subscribe before looking for the message, so that a message saved in
+	// between is not missed
+	var events <-chan hub.Event
+	if s.hub != nil {
+		var unsubscribe func()
+		events, unsubscribe = s.hub.Subscribe(inbox.Id)
+		defer unsubscribe()
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		email, err := filter.find(s.db, inbox.Id)
+		if err != nil {
+			log.Printf("failed to fetch emails: %s", err)
+			sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+			return
+		}
+
+		if email != nil {
+			msg, err := s.buildMessageResponse(email)
+			if err != nil {
+				log.Printf("failed to get email %d: %s", email.Id, err)
+				sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+				return
+			}
+
+			sendResponse(w, http.StatusOK, msg)
+			return
+		}
+
+		select {
+		case e := <-events:
+			if e.Type != hub.MessageCreated {
+				continue
+			}
+		case <-timer.C:
+			sendError(w, http.StatusRequestTimeout, waitTimeoutMsg)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	ent "github.com/supriyo-biswas/postbox/entities"
+	"github.com/supriyo-biswas/postbox/utils"
+	"gorm.io/gorm"
+)
+
+// MessagePayload returns the representation of an email that is sent to
+// webhooks, which is the same as the one returned by the message API.
+func (s *Server) MessagePayload(email *ent.Email) (any, error) {
+	return s.buildMessageResponse(email)
+}
+
+func (s *Server) getWebhook(w http.ResponseWriter, r *http.Request) *ent.Webhook {
+	inbox := r.Context().Value(inboxContextKey).(*ent.Inbox)
+	hookId, err := strconv.ParseInt(mux.Vars(r)["webhook"], 10, 64)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, invalidWebhookIdMsg)
+		return nil
+	}
+
+	var hook ent.Webhook
+	tx := s.db.Where("inbox_id = ? AND id = ?", inbox.Id, hookId).First(&hook)
+	if tx.Error != nil {
+		if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+			sendError(w, http.StatusNotFound, webhookNotFoundMsg)
+		} else {
+			log.Printf("failed to get webhook: %s", tx.Error)
+			sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		}
+		return nil
+	}
+
+	return &hook
+}
+
+func (s *Server) listWebhooks(w http.ResponseWriter, r *http.Request) {
+	inbox := r.Context().Value(inboxContextKey).(*ent.Inbox)
+
+	var hooks []ent.Webhook
+	tx := s.db.Where("inbox_id = ?", inbox.Id).Order("id").Find(&hooks)
+	if tx.Error != nil {
+		log.Printf("failed to get webhooks for inbox %d: %s", inbox.Id, tx.Error)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	result := make([]Webhook, len(hooks))
+	for i, hook := range hooks {
+		result[i] = *buildWebhookResponse(&hook)
+	}
+
+	sendResponse(w, http.StatusOK, result)
+}
+
+func (s *Server) createWebhook(w http.ResponseWriter, r *http.Request) {
+	inbox := r.Context().Value(inboxContextKey).(*ent.Inbox)
+
+	var req CreateWebhook
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, http.StatusBadRequest, invalidRequestMsg)
+		return
+	}
+
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		sendError(w, http.StatusBadRequest, invalidWebhookUrlMsg)
+		return
+	}
+
+	secret := req.Secret
+	if secret == "" {
+		if secret, err = utils.RandomString(24); err != nil {
+			log.Printf("failed to generate webhook secret: %s", err)
+			sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+			return
+		}
+	}
+
+	hook := ent.Webhook{
+		InboxId: inbox.Id,
+		URL:     u.String(),
+		Secret:  secret,
+	}
+
+	if err := s.db.Create(&hook).Error; err != nil {
+		log.Printf("failed to create webhook for inbox %d: %s", inbox.Id, err)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	// the secret is only returned here, so that it isn't exposed to
+	// everyone who can read the inbox later
+	sendResponse(w, http.StatusCreated, WebhookWithSecret{
+		Webhook: *buildWebhookResponse(&hook),
+		Secret:  hook.Secret,
+	})
+}
+
+func (s *Server) deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	hook := s.getWebhook(w, r)
+	if hook == nil {
+		return
+	}
+
+	if err := s.db.Delete(hook).Error; err != nil {
+		log.Printf("failed to delete webhook %d: %s", hook.Id, err)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	sendResponse(w, http.StatusOK, buildWebhookResponse(hook))
+}
+
+func (s *Server) listWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	hook := s.getWebhook(w, r)
+	if hook == nil {
+		return
+	}
+
+	var deliveries []ent.WebhookDelivery
+	tx := s.db.Where("webhook_id = ?", hook.Id).Order("id").Find(&deliveries)
+	if tx.Error != nil {
+		log.Printf("failed to get deliveries for webhook %d: %s", hook.Id, tx.Error)
+		sendError(w, http.StatusInternalServerError, internalServerErrorMsg)
+		return
+	}
+
+	result := make([]WebhookDelivery, len(deliveries))
+	for i, delivery := range deliveries {
+		result[i] = *buildWebhookDeliveryResponse(&delivery)
+	}
+
+	sendResponse(w, http.StatusOK, result)
+}
@@ -0,0 +1,275 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spf13/cobra"
+	ent "github.com/supriyo-biswas/postbox/entities"
+	"github.com/supriyo-biswas/postbox/utils"
+	"gorm.io/gorm"
+)
+
+func findAccount(d *gorm.DB, name string) (*ent.Account, error) {
+	var account ent.Account
+	err := d.Where("name = ?", name).First(&account).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("account %s not found", name)
+		}
+		return nil, fmt.Errorf("failed to query account: %s", err)
+	}
+
+	return &account, nil
+}
+
+func runAccountAddCmd(cmd *cobra.Command, args []string) error {
+	cfg, err := readConfig(cmd.Root().PersistentFlags())
+	if err != nil {
+		return fmt.Errorf("failed to read config: %s", err)
+	}
+
+	d, err := openDb(cfg.Database.Path)
+	if err != nil {
+		return err
+	}
+
+	var count int64
+	if err := d.Model(&ent.Account{}).Where("name = ?", args[0]).Count(&count).Error; err != nil {
+		return fmt.Errorf("failed to query account: %s", err)
+	}
+
+	if count > 0 {
+		return fmt.Errorf("account %s already exists", args[0])
+	}
+
+	token, err := utils.RandomString(32)
+	if err != nil {
+		return fmt.Errorf("failed to generate account token: %s", err)
+	}
+
+	account := ent.Account{Name: args[0], TokenHash: utils.HashSecret(token)}
+	if err := d.Create(&account).Error; err != nil {
+		return fmt.Errorf("failed to create account: %s", err)
+	}
+
+	fmt.Printf("Account ID: %d\n", account.Id)
+	fmt.Printf("Account token: %s\n", token)
+	return nil
+}
+
+func runAccountListCmd(cmd *cobra.Command, args []string) error {
+	cfg, err := readConfig(cmd.Root().PersistentFlags())
+	if err != nil {
+		return fmt.Errorf("failed to read config: %s", err)
+	}
+
+	d, err := openDb(cfg.Database.Path)
+	if err != nil {
+		return err
+	}
+
+	var accounts []ent.Account
+	if err := d.Order("id").Find(&accounts).Error; err != nil {
+		return fmt.Errorf("failed to query accounts: %s", err)
+	}
+
+	for _, account := range accounts {
+		var inboxes []string
+		err := d.Model(&ent.Inbox{}).Where("account_id = ?", account.Id).Order("name").Pluck("name", &inboxes).Error
+		if err != nil {
+			return fmt.Errorf("failed to query inboxes: %s", err)
+		}
+
+		fmt.Printf("%d\t%s\t%d inboxes\n", account.Id, account.Name, len(inboxes))
+		for _, name := range inboxes {
+			fmt.Printf("\t%s\n", name)
+		}
+	}
+
+	return nil
+}
+
+func runAccountRotateCmd(cmd *cobra.Command, args []string) error {
+	cfg, err := readConfig(cmd.Root().PersistentFlags())
+	if err != nil {
+		return fmt.Errorf("failed to read config: %s", err)
+	}
+
+	d, err := openDb(cfg.Database.Path)
+	if err != nil {
+		return err
+	}
+
+	account, err := findAccount(d, args[0])
+	if err != nil {
+		return err
+	}
+
+	token, err := utils.RandomString(32)
+	if err != nil {
+		return fmt.Errorf("failed to generate account token: %s", err)
+	}
+
+	account.TokenHash = utils.HashSecret(token)
+	if err := d.Save(account).Error; err != nil {
+		return fmt.Errorf("failed to update account: %s", err)
+	}
+
+	fmt.Printf("Account ID: %d\n", account.Id)
+	fmt.Printf("Account token: %s\n", token)
+	return nil
+}
+
+func runAccountRemoveCmd(cmd *cobra.Command, args []string) error {
+	cfg, err := readConfig(cmd.Root().PersistentFlags())
+	if err != nil {
+		return fmt.Errorf("failed to read config: %s", err)
+	}
+
+	d, err := openDb(cfg.Database.Path)
+	if err != nil {
+		return err
+	}
+
+	account, err := findAccount(d, args[0])
+	if err != nil {
+		return err
+	}
+
+	// the inboxes of the account are kept, without an account
+	err = d.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&ent.Inbox{}).Where("account_id = ?", account.Id).Update("account_id", nil).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Delete(account).Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete account: %s", err)
+	}
+
+	return nil
+}
+
+// setInboxAccount moves inboxes to an account, or removes them from their
+// accounts if it is nil.
+func setInboxAccount(d *gorm.DB, account *ent.Account, names []string) error {
+	var accountId *int64
+	if account != nil {
+		accountId = &account.Id
+	}
+
+	for _, name := range names {
+		inbox, err := findInbox(d, name)
+		if err != nil {
+			return err
+		}
+
+		err = d.Model(inbox).Update("account_id", accountId).Error
+		if err != nil {
+			return fmt.Errorf("failed to update inbox %s: %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+func runAccountAssignCmd(cmd *cobra.Command, args []string) error {
+	cfg, err := readConfig(cmd.Root().PersistentFlags())
+	if err != nil {
+		return fmt.Errorf("failed to read config: %s", err)
+	}
+
+	d, err := openDb(cfg.Database.Path)
+	if err != nil {
+		return err
+	}
+
+	account, err := findAccount(d, args[0])
+	if err != nil {
+		return err
+	}
+
+	return setInboxAccount(d, account, args[1:])
+}
+
+func runAccountUnassignCmd(cmd *cobra.Command, args []string) error {
+	cfg, err := readConfig(cmd.Root().PersistentFlags())
+	if err != nil {
+		return fmt.Errorf("failed to read config: %s", err)
+	}
+
+	d, err := openDb(cfg.Database.Path)
+	if err != nil {
+		return err
+	}
+
+	return setInboxAccount(d, nil, args)
+}
+
+var accountCmd = &cobra.Command{
+	Use:   "account",
+	Short: "Manage accounts, which own inboxes",
+}
+
+var accountAddCmd = &cobra.Command{
+	Use:          "add account",
+	Aliases:      []string{"create"},
+	Short:        "Add an account",
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE:         runAccountAddCmd,
+}
+
+var accountListCmd = &cobra.Command{
+	Use:          "list",
+	Aliases:      []string{"ls"},
+	Short:        "List accounts and their inboxes",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE:         runAccountListCmd,
+}
+
+var accountRotateCmd = &cobra.Command{
+	Use:          "rotate account",
+	Short:        "Rotate an account's token",
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE:         runAccountRotateCmd,
+}
+
+var accountRemoveCmd = &cobra.Command{
+	Use:          "remove account",
+	Aliases:      []string{"rm", "delete"},
+	Short:        "Delete an account, keeping its inboxes",
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE:         runAccountRemoveCmd,
+}
+
+var accountAssignCmd = &cobra.Command{
+	Use:          "assign account inbox...",
+	Short:        "Move inboxes to an account",
+	Args:         cobra.MinimumNArgs(2),
+	SilenceUsage: true,
+	RunE:         runAccountAssignCmd,
+}
+
+var accountUnassignCmd = &cobra.Command{
+	Use:          "unassign inbox...",
+	Short:        "Remove inboxes from their account",
+	Args:         cobra.MinimumNArgs(1),
+	SilenceUsage: true,
+	RunE:         runAccountUnassignCmd,
+}
+
+func init() {
+	accountCmd.AddCommand(accountAddCmd)
+	accountCmd.AddCommand(accountListCmd)
+	accountCmd.AddCommand(accountRotateCmd)
+	accountCmd.AddCommand(accountRemoveCmd)
+	accountCmd.AddCommand(accountAssignCmd)
+	accountCmd.AddCommand(accountUnassignCmd)
+}
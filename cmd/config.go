@@ -2,15 +2,18 @@ package cmd
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
 
 	"github.com/BurntSushi/toml"
 	"github.com/adrg/xdg"
 	"github.com/spf13/pflag"
+	ent "github.com/supriyo-biswas/postbox/entities"
 )
 
 type CredentialConfig struct {
@@ -22,6 +25,8 @@ type Config struct {
 	Server   *ServerConfig   `toml:"server"`
 	Database *DatabaseConfig `toml:"database"`
 	Logging  *LoggingConfig  `toml:"logging"`
+	Relay    *RelayConfig    `toml:"relay"`
+	Oidc     *OidcConfig     `toml:"oidc"`
 }
 
 type ServerConfig struct {
@@ -37,9 +42,49 @@ type SmtpConfig struct {
 }
 
 type HttpConfig struct {
-	Listen   string `toml:"listen"`
-	KeyFile  string `toml:"key_file"`
-	CertFile string `toml:"cert_file"`
+	Listen     string `toml:"listen"`
+	KeyFile    string `toml:"key_file"`
+	CertFile   string `toml:"cert_file"`
+	AdminToken string `toml:"admin_token"`
+}
+
+type RelayConfig struct {
+	Host               string `toml:"host"`
+	Port               int    `toml:"port"`
+	Username           string `toml:"username"`
+	Password           string `toml:"password"`
+	TLS                string `toml:"tls"`
+	InsecureSkipVerify bool   `toml:"insecure_skip_verify"`
+	MailFrom           string `toml:"mail_from"`
+	HeloName           string `toml:"helo_name"`
+
+	Dkim []*DkimConfig `toml:"dkim"`
+}
+
+type DkimConfig struct {
+	Domain   string   `toml:"domain"`
+	Selector string   `toml:"selector"`
+	KeyFile  string   `toml:"key_file"`
+	Headers  []string `toml:"headers"`
+}
+
+type OidcConfig struct {
+	Issuer             string   `toml:"issuer"`
+	ClientId           string   `toml:"client_id"`
+	ClientSecret       string   `toml:"client_secret"`
+	RedirectURL        string   `toml:"redirect_url"`
+	Scopes             []string `toml:"scopes"`
+	UsernameClaim      string   `toml:"username_claim"`
+	GroupsClaim        string   `toml:"groups_claim"`
+	InsecureSkipVerify bool     `toml:"insecure_skip_verify"`
+
+	Groups []*OidcGroupConfig `toml:"groups"`
+}
+
+type OidcGroupConfig struct {
+	Group   string   `toml:"group"`
+	Inboxes []string `toml:"inboxes"`
+	Role    string   `toml:"role"`
 }
 
 type DatabaseConfig struct {
@@ -109,8 +154,9 @@ func readConfig(flags *pflag.FlagSet) (*Config, error) {
 			return nil, errors.New("conflicting SMTP listen address: " +
 				"specified in both config and command line")
 		}
-	} else {
-		cfg.Server.Smtp.Listen = ":" + flags.Lookup("smtp-port").Value.String()
+	} else if port := flags.Lookup("smtp-port"); port != nil {
+		// the port flags are only defined for the server command
+		cfg.Server.Smtp.Listen = ":" + port.Value.String()
 	}
 
 	dir := filepath.Dir(cfgFile)
@@ -146,8 +192,8 @@ func readConfig(flags *pflag.FlagSet) (*Config, error) {
 			return nil, errors.New("conflicting HTTP listen address: " +
 				"specified in both config and command line")
 		}
-	} else {
-		cfg.Server.Http.Listen = ":" + flags.Lookup("http-port").Value.String()
+	} else if port := flags.Lookup("http-port"); port != nil {
+		cfg.Server.Http.Listen = ":" + port.Value.String()
 	}
 
 	cfg.Server.Http.KeyFile = getDefaultPath(cfg.Server.Http.KeyFile, dir, "key.pem")
@@ -169,5 +215,53 @@ func readConfig(flags *pflag.FlagSet) (*Config, error) {
 		cfg.Logging.Filename = path.Join(baseDataPath, cfg.Logging.Filename)
 	}
 
+	if cfg.Relay != nil {
+		if cfg.Relay.Host == "" {
+			return nil, errors.New("relay.host must be set to enable the relay")
+		}
+
+		for _, dc := range cfg.Relay.Dkim {
+			if dc.Domain == "" || dc.Selector == "" || dc.KeyFile == "" {
+				return nil, errors.New("relay.dkim entries must set domain, selector and key_file")
+			}
+
+			if !filepath.IsAbs(dc.KeyFile) {
+				dc.KeyFile = path.Join(dir, dc.KeyFile)
+			}
+		}
+	}
+
+	if oc := cfg.Oidc; oc != nil {
+		if oc.Issuer == "" || oc.ClientId == "" || oc.RedirectURL == "" {
+			return nil, errors.New("oidc.issuer, oidc.client_id and oidc.redirect_url must be set to enable OIDC")
+		}
+
+		if oc.UsernameClaim == "" {
+			oc.UsernameClaim = "preferred_username"
+		}
+
+		if oc.GroupsClaim == "" {
+			oc.GroupsClaim = "groups"
+		}
+
+		for _, gc := range oc.Groups {
+			if gc.Group == "" || len(gc.Inboxes) == 0 {
+				return nil, errors.New("oidc.groups entries must set group and inboxes")
+			}
+
+			if gc.Role == "" {
+				gc.Role = string(ent.RoleViewer)
+			} else if !slices.Contains(ent.MembershipRoles, ent.MembershipRole(gc.Role)) {
+				return nil, fmt.Errorf("invalid role %s in oidc.groups", gc.Role)
+			}
+
+			for _, pattern := range gc.Inboxes {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return nil, fmt.Errorf("invalid inbox pattern %s in oidc.groups", pattern)
+				}
+			}
+		}
+	}
+
 	return &cfg, nil
 }
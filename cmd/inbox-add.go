@@ -3,6 +3,7 @@ package cmd
 import (
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/spf13/cobra"
 	ent "github.com/supriyo-biswas/postbox/entities"
@@ -21,16 +22,47 @@ func runInboxAddCmd(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	ttl, _ := cmd.Flags().GetDuration("ttl")
+	if ttl < 0 {
+		return errors.New("ttl must be positive")
+	}
+
+	var expiresAt *time.Time
+	if ttl > 0 {
+		t := time.Now().Add(ttl)
+		expiresAt = &t
+	}
+
+	var name string
+	if len(args) > 0 {
+		name = args[0]
+	} else if expiresAt != nil {
+		if name, err = utils.RandomName(ent.TemporaryInboxPrefix, 12); err != nil {
+			return fmt.Errorf("failed to generate inbox name: %s", err)
+		}
+	} else {
+		return errors.New("an inbox name is required unless --ttl is set")
+	}
+
 	var inbox ent.Inbox
-	err = d.Where("name = ?", args[0]).First(&inbox).Error
+	err = d.Where("name = ?", name).First(&inbox).Error
 	if err == nil {
-		return fmt.Errorf("inbox %s already exists", args[0])
+		return fmt.Errorf("inbox %s already exists", name)
 	}
 
 	if !errors.Is(err, gorm.ErrRecordNotFound) {
 		return fmt.Errorf("failed to query inbox: %s", err)
 	}
 
+	var accountId *int64
+	if accountName, _ := cmd.Flags().GetString("account"); accountName != "" {
+		account, err := findAccount(d, accountName)
+		if err != nil {
+			return err
+		}
+		accountId = &account.Id
+	}
+
 	path, _ := cmd.Flags().GetString("credential-file")
 	newCreds, err := newCredentials(path)
 	if err != nil {
@@ -38,9 +70,11 @@ func runInboxAddCmd(cmd *cobra.Command, args []string) error {
 	}
 
 	inbox = ent.Inbox{
-		Name:     args[0],
-		SmtpPass: utils.HashSecret(newCreds.SmtpPass),
-		ApiKey:   utils.HashSecret(newCreds.ApiKey),
+		Name:      name,
+		SmtpPass:  utils.HashSecret(newCreds.SmtpPass),
+		ApiKey:    utils.HashSecret(newCreds.ApiKey),
+		AccountId: accountId,
+		ExpiresAt: expiresAt,
 	}
 
 	if err = d.Create(&inbox).Error; err != nil {
@@ -48,24 +82,29 @@ func runInboxAddCmd(cmd *cobra.Command, args []string) error {
 	}
 
 	fmt.Printf("Inbox ID: %d\n", inbox.Id)
-	fmt.Printf("SMTP username: %s\n", args[0])
+	fmt.Printf("SMTP username: %s\n", name)
 	if path == "" {
 		fmt.Printf("SMTP password: %s\n", newCreds.SmtpPass)
 		fmt.Printf("API key: %s\n", newCreds.ApiKey)
 	}
+	if expiresAt != nil {
+		fmt.Printf("Expires at: %s\n", expiresAt.Format(time.RFC3339))
+	}
 
 	return nil
 }
 
 var inboxAddCmd = &cobra.Command{
-	Use:          "add inbox",
+	Use:          "add [inbox]",
 	Aliases:      []string{"create"},
 	Short:        "Add an inbox",
-	Args:         cobra.ExactArgs(1),
+	Args:         cobra.MaximumNArgs(1),
 	SilenceUsage: true,
 	RunE:         runInboxAddCmd,
 }
 
 func init() {
 	inboxAddCmd.Flags().StringP("credential-file", "f", "", "Use credentials in JSON file")
+	inboxAddCmd.Flags().String("account", "", "Add the inbox to an account")
+	inboxAddCmd.Flags().Duration("ttl", 0, "Create a temporary inbox that is deleted after this duration, with a random name if none is given")
 }
@@ -0,0 +1,211 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	ent "github.com/supriyo-biswas/postbox/entities"
+	"github.com/supriyo-biswas/postbox/utils"
+)
+
+// parseScopes validates a list of API key scopes, and returns them in the
+// form they're saved in.
+func parseScopes(scopes []string) (string, error) {
+	var result []string
+	for _, scope := range scopes {
+		scope = strings.ToLower(strings.TrimSpace(scope))
+		if !slices.Contains(ent.ApiKeyScopes, ent.ApiKeyScope(scope)) {
+			return "", fmt.Errorf("invalid scope %s", scope)
+		}
+
+		if !slices.Contains(result, scope) {
+			result = append(result, scope)
+		}
+	}
+
+	if len(result) == 0 {
+		return "", errors.New("at least one scope is required")
+	}
+
+	return strings.Join(result, ","), nil
+}
+
+func formatOptionalTime(t *time.Time) string {
+	if t == nil {
+		return "never"
+	}
+
+	return t.Format(time.RFC3339)
+}
+
+func runInboxApiKeyAddCmd(cmd *cobra.Command, args []string) error {
+	cfg, err := readConfig(cmd.Root().PersistentFlags())
+	if err != nil {
+		return fmt.Errorf("failed to read config: %s", err)
+	}
+
+	scopeList, _ := cmd.Flags().GetStringSlice("scopes")
+	scopes, err := parseScopes(scopeList)
+	if err != nil {
+		return err
+	}
+
+	ttl, _ := cmd.Flags().GetDuration("ttl")
+	if ttl < 0 {
+		return errors.New("ttl must be positive")
+	}
+
+	d, err := openDb(cfg.Database.Path)
+	if err != nil {
+		return err
+	}
+
+	inbox, err := findInbox(d, args[0])
+	if err != nil {
+		return err
+	}
+
+	var count int64
+	err = d.Model(&ent.ApiKey{}).Where("inbox_id = ? AND name = ?", inbox.Id, args[1]).Count(&count).Error
+	if err != nil {
+		return fmt.Errorf("failed to query API keys: %s", err)
+	}
+
+	if count > 0 {
+		return fmt.Errorf("API key %s already exists", args[1])
+	}
+
+	secret, err := utils.RandomString(32)
+	if err != nil {
+		return fmt.Errorf("failed to generate API key: %s", err)
+	}
+
+	key := ent.ApiKey{
+		InboxId: inbox.Id,
+		Name:    args[1],
+		KeyHash: utils.HashSecret(secret),
+		Scopes:  scopes,
+	}
+
+	if ttl > 0 {
+		t := time.Now().Add(ttl)
+		key.ExpiresAt = &t
+	}
+
+	if err := d.Create(&key).Error; err != nil {
+		return fmt.Errorf("failed to add API key: %s", err)
+	}
+
+	fmt.Printf("API key: %s\n", secret)
+	fmt.Printf("Scopes: %s\n", key.Scopes)
+	fmt.Printf("Expires at: %s\n", formatOptionalTime(key.ExpiresAt))
+	return nil
+}
+
+func runInboxApiKeyListCmd(cmd *cobra.Command, args []string) error {
+	cfg, err := readConfig(cmd.Root().PersistentFlags())
+	if err != nil {
+		return fmt.Errorf("failed to read config: %s", err)
+	}
+
+	d, err := openDb(cfg.Database.Path)
+	if err != nil {
+		return err
+	}
+
+	inbox, err := findInbox(d, args[0])
+	if err != nil {
+		return err
+	}
+
+	var keys []ent.ApiKey
+	err = d.Where("inbox_id = ?", inbox.Id).Order("name").Find(&keys).Error
+	if err != nil {
+		return fmt.Errorf("failed to query API keys: %s", err)
+	}
+
+	for _, key := range keys {
+		expires := formatOptionalTime(key.ExpiresAt)
+		if key.Expired() {
+			expires += " (expired)"
+		}
+
+		fmt.Printf("%s\t%s\texpires: %s\tlast used: %s\n",
+			key.Name, key.Scopes, expires, formatOptionalTime(key.LastUsedAt))
+	}
+
+	return nil
+}
+
+func runInboxApiKeyRevokeCmd(cmd *cobra.Command, args []string) error {
+	cfg, err := readConfig(cmd.Root().PersistentFlags())
+	if err != nil {
+		return fmt.Errorf("failed to read config: %s", err)
+	}
+
+	d, err := openDb(cfg.Database.Path)
+	if err != nil {
+		return err
+	}
+
+	inbox, err := findInbox(d, args[0])
+	if err != nil {
+		return err
+	}
+
+	tx := d.Where("inbox_id = ? AND name = ?", inbox.Id, args[1]).Delete(&ent.ApiKey{})
+	if tx.Error != nil {
+		return fmt.Errorf("failed to revoke API key: %s", tx.Error)
+	}
+
+	if tx.RowsAffected == 0 {
+		return fmt.Errorf("API key %s not found", args[1])
+	}
+
+	return nil
+}
+
+var inboxApiKeyCmd = &cobra.Command{
+	Use:   "apikey",
+	Short: "Manage additional API keys of an inbox",
+}
+
+var inboxApiKeyAddCmd = &cobra.Command{
+	Use:          "add inbox name",
+	Aliases:      []string{"issue", "create"},
+	Short:        "Issue an API key for an inbox",
+	Args:         cobra.ExactArgs(2),
+	SilenceUsage: true,
+	RunE:         runInboxApiKeyAddCmd,
+}
+
+var inboxApiKeyListCmd = &cobra.Command{
+	Use:          "list inbox",
+	Aliases:      []string{"ls"},
+	Short:        "List the API keys of an inbox",
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE:         runInboxApiKeyListCmd,
+}
+
+var inboxApiKeyRevokeCmd = &cobra.Command{
+	Use:          "revoke inbox name",
+	Aliases:      []string{"rm", "remove", "delete"},
+	Short:        "Revoke an API key of an inbox",
+	Args:         cobra.ExactArgs(2),
+	SilenceUsage: true,
+	RunE:         runInboxApiKeyRevokeCmd,
+}
+
+func init() {
+	inboxApiKeyAddCmd.Flags().StringSlice("scopes", []string{"read", "write"}, "Scopes of the API key (read, write, admin)")
+	inboxApiKeyAddCmd.Flags().Duration("ttl", 0, "Expire the API key after this duration")
+
+	inboxApiKeyCmd.AddCommand(inboxApiKeyAddCmd)
+	inboxApiKeyCmd.AddCommand(inboxApiKeyListCmd)
+	inboxApiKeyCmd.AddCommand(inboxApiKeyRevokeCmd)
+}
@@ -0,0 +1,173 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	ent "github.com/supriyo-biswas/postbox/entities"
+	"github.com/supriyo-biswas/postbox/parsemail"
+	"gorm.io/gorm"
+)
+
+func findInbox(d *gorm.DB, name string) (*ent.Inbox, error) {
+	var inbox ent.Inbox
+	err := d.Select("id").Where("name = ?", name).First(&inbox).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("inbox %s not found", name)
+		}
+		return nil, fmt.Errorf("failed to query inbox: %s", err)
+	}
+
+	return &inbox, nil
+}
+
+func runInboxKeyringAddCmd(cmd *cobra.Command, args []string) error {
+	cfg, err := readConfig(cmd.Root().PersistentFlags())
+	if err != nil {
+		return fmt.Errorf("failed to read config: %s", err)
+	}
+
+	d, err := openDb(cfg.Database.Path)
+	if err != nil {
+		return err
+	}
+
+	inbox, err := findInbox(d, args[0])
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(args[1])
+	if err != nil {
+		return fmt.Errorf("failed to read key file: %s", err)
+	}
+
+	info, err := parsemail.NewKeyring().Add(data)
+	if err != nil {
+		return fmt.Errorf("failed to load keys from %s: %s", args[1], err)
+	}
+
+	key := ent.InboxKey{
+		InboxId:     inbox.Id,
+		Type:        info.Type,
+		Private:     info.Private,
+		Description: strings.Join(info.Names, ", "),
+		Data:        data,
+	}
+
+	if err := d.Create(&key).Error; err != nil {
+		return fmt.Errorf("failed to add key: %s", err)
+	}
+
+	fmt.Printf("Key ID: %d\n", key.Id)
+	return nil
+}
+
+func runInboxKeyringListCmd(cmd *cobra.Command, args []string) error {
+	cfg, err := readConfig(cmd.Root().PersistentFlags())
+	if err != nil {
+		return fmt.Errorf("failed to read config: %s", err)
+	}
+
+	d, err := openDb(cfg.Database.Path)
+	if err != nil {
+		return err
+	}
+
+	inbox, err := findInbox(d, args[0])
+	if err != nil {
+		return err
+	}
+
+	var keys []ent.InboxKey
+	err = d.Select("id, type, private, description").Where("inbox_id = ?", inbox.Id).Order("id").Find(&keys).Error
+	if err != nil {
+		return fmt.Errorf("failed to query keys: %s", err)
+	}
+
+	for _, key := range keys {
+		kind := "public"
+		if key.Private {
+			kind = "private"
+		}
+
+		fmt.Printf("%d\t%s\t%s\t%s\n", key.Id, key.Type, kind, key.Description)
+	}
+
+	return nil
+}
+
+func runInboxKeyringRemoveCmd(cmd *cobra.Command, args []string) error {
+	cfg, err := readConfig(cmd.Root().PersistentFlags())
+	if err != nil {
+		return fmt.Errorf("failed to read config: %s", err)
+	}
+
+	d, err := openDb(cfg.Database.Path)
+	if err != nil {
+		return err
+	}
+
+	inbox, err := findInbox(d, args[0])
+	if err != nil {
+		return err
+	}
+
+	id, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid key id: %s", args[1])
+	}
+
+	tx := d.Where("inbox_id = ? AND id = ?", inbox.Id, id).Delete(&ent.InboxKey{})
+	if tx.Error != nil {
+		return fmt.Errorf("failed to delete key: %s", tx.Error)
+	}
+
+	if tx.RowsAffected == 0 {
+		return fmt.Errorf("key %d not found", id)
+	}
+
+	return nil
+}
+
+var inboxKeyringCmd = &cobra.Command{
+	Use:   "keyring",
+	Short: "Manage the keys used to verify and decrypt an inbox's emails",
+}
+
+var inboxKeyringAddCmd = &cobra.Command{
+	Use:          "add inbox file",
+	Short:        "Add S/MIME certificates and keys (PEM) or an OpenPGP keyring (armored)",
+	Args:         cobra.ExactArgs(2),
+	SilenceUsage: true,
+	RunE:         runInboxKeyringAddCmd,
+}
+
+var inboxKeyringListCmd = &cobra.Command{
+	Use:          "list inbox",
+	Aliases:      []string{"ls"},
+	Short:        "List the keys of an inbox",
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE:         runInboxKeyringListCmd,
+}
+
+var inboxKeyringRemoveCmd = &cobra.Command{
+	Use:          "remove inbox id",
+	Aliases:      []string{"rm", "delete"},
+	Short:        "Remove a key from an inbox",
+	Args:         cobra.ExactArgs(2),
+	SilenceUsage: true,
+	RunE:         runInboxKeyringRemoveCmd,
+}
+
+func init() {
+	inboxKeyringCmd.AddCommand(inboxKeyringAddCmd)
+	inboxKeyringCmd.AddCommand(inboxKeyringListCmd)
+	inboxKeyringCmd.AddCommand(inboxKeyringRemoveCmd)
+}
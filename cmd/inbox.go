@@ -13,4 +13,6 @@ func init() {
 	inboxCmd.AddCommand(inboxCleanCmd)
 	inboxCmd.AddCommand(inboxRemoveCmd)
 	inboxCmd.AddCommand(inboxRotateCmd)
+	inboxCmd.AddCommand(inboxKeyringCmd)
+	inboxCmd.AddCommand(inboxApiKeyCmd)
 }
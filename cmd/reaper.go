@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"log"
+	"time"
+
+	ent "github.com/supriyo-biswas/postbox/entities"
+	"gorm.io/gorm"
+)
+
+const reapInterval = time.Minute
+
+// deleteExpiredInboxes deletes the temporary inboxes that are past their
+// expiry time, along with their messages.
+func deleteExpiredInboxes(d *gorm.DB) (int64, error) {
+	tx := d.Where("expires_at <= ?", time.Now()).Delete(&ent.Inbox{})
+	return tx.RowsAffected, tx.Error
+}
+
+// deleteExpiredSessions deletes the web interface sessions that have
+// expired.
+func deleteExpiredSessions(d *gorm.DB) error {
+	return d.Where("expires_at <= ?", time.Now()).Delete(&ent.Session{}).Error
+}
+
+// reapExpired periodically deletes expired inboxes and sessions. It doesn't
+// return.
+func reapExpired(d *gorm.DB) {
+	for {
+		n, err := deleteExpiredInboxes(d)
+		if err != nil {
+			log.Printf("failed to delete expired inboxes: %s", err)
+		} else if n > 0 {
+			log.Printf("deleted %d expired inboxes", n)
+		}
+
+		if err := deleteExpiredSessions(d); err != nil {
+			log.Printf("failed to delete expired sessions: %s", err)
+		}
+
+		time.Sleep(reapInterval)
+	}
+}
@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+func runReindexCmd(cmd *cobra.Command, args []string) error {
+	cfg, err := readConfig(cmd.Root().PersistentFlags())
+	if err != nil {
+		return fmt.Errorf("failed to read config: %s", err)
+	}
+
+	_, idx, err := openDbWithIndex(cfg.Database.Path)
+	if err != nil {
+		return err
+	}
+
+	if idx == nil {
+		return errors.New("full-text search is not available; build postbox with -tags sqlite_fts5 to enable it")
+	}
+
+	if err := idx.Rebuild(); err != nil {
+		return fmt.Errorf("failed to rebuild search index: %s", err)
+	}
+
+	return nil
+}
+
+var reindexCmd = &cobra.Command{
+	Use:          "reindex",
+	Short:        "Rebuild the full-text search index",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE:         runReindexCmd,
+}
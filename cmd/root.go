@@ -18,6 +18,9 @@ var rootCmd = &cobra.Command{
 func init() {
 	rootCmd.AddCommand(serverCmd)
 	rootCmd.AddCommand(inboxCmd)
+	rootCmd.AddCommand(accountCmd)
+	rootCmd.AddCommand(userCmd)
+	rootCmd.AddCommand(reindexCmd)
 
 	cfgFile, err := xdg.ConfigFile("postbox/config.toml")
 	if err != nil {
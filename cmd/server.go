@@ -12,9 +12,14 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/spf13/cobra"
 	"github.com/supriyo-biswas/postbox/api"
+	"github.com/supriyo-biswas/postbox/dkim"
 	ent "github.com/supriyo-biswas/postbox/entities"
+	"github.com/supriyo-biswas/postbox/hub"
+	"github.com/supriyo-biswas/postbox/oidc"
+	"github.com/supriyo-biswas/postbox/relay"
 	"github.com/supriyo-biswas/postbox/smtp"
 	"github.com/supriyo-biswas/postbox/utils"
+	"github.com/supriyo-biswas/postbox/webhook"
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
@@ -34,7 +39,7 @@ func runServerCmd(cmd *cobra.Command, args []string) error {
 		}
 	}
 
-	d, err := openDb(cfg.Database.Path)
+	d, idx, err := openDbWithIndex(cfg.Database.Path)
 	if err != nil {
 		return err
 	}
@@ -94,9 +99,60 @@ func runServerCmd(cmd *cobra.Command, args []string) error {
 		httpCert = &cert
 	}
 
+	var mailRelay *relay.Relay
+	if rc := cfg.Relay; rc != nil {
+		mailRelay, err = relay.NewRelay(rc.Host, rc.Port, rc.Username, rc.Password,
+			rc.TLS, rc.InsecureSkipVerify)
+		if err != nil {
+			return fmt.Errorf("failed to configure relay: %s", err)
+		}
+
+		mailRelay.SetMailFrom(rc.MailFrom)
+		mailRelay.SetHeloName(rc.HeloName)
+
+		for _, dc := range rc.Dkim {
+			key, err := dkim.LoadPrivateKey(dc.KeyFile)
+			if err != nil {
+				return fmt.Errorf("failed to load DKIM key: %s", err)
+			}
+
+			signer, err := dkim.NewSigner(dc.Domain, dc.Selector, key, dc.Headers)
+			if err != nil {
+				return fmt.Errorf("failed to configure DKIM signer: %s", err)
+			}
+
+			mailRelay.AddSigner(signer)
+		}
+	}
+
+	var oidcLogin *api.OidcLogin
+	if oc := cfg.Oidc; oc != nil {
+		provider := oidc.NewProvider(oc.Issuer, oc.ClientId, oc.ClientSecret, oc.RedirectURL,
+			oc.InsecureSkipVerify)
+		provider.SetScopes(oc.Scopes)
+
+		oidcLogin = &api.OidcLogin{
+			Provider:      provider,
+			UsernameClaim: oc.UsernameClaim,
+			GroupsClaim:   oc.GroupsClaim,
+		}
+
+		for _, gc := range oc.Groups {
+			oidcLogin.Groups = append(oidcLogin.Groups, api.OidcGroup{
+				Group:   gc.Group,
+				Inboxes: gc.Inboxes,
+				Role:    ent.MembershipRole(gc.Role),
+			})
+		}
+	}
+
 	log.Printf("Starting postbox server (smtp: %s, http: %s)\n",
 		cfg.Server.Smtp.Listen, cfg.Server.Http.Listen)
 
+	if idx == nil {
+		log.Printf("Full-text search is not available; build postbox with -tags sqlite_fts5 to enable it")
+	}
+
 	smtpListener, err := net.Listen("tcp", cfg.Server.Smtp.Listen)
 	if err != nil {
 		return fmt.Errorf("failed to listen on SMTP port: %s", err)
@@ -108,9 +164,30 @@ func runServerCmd(cmd *cobra.Command, args []string) error {
 	}
 
 	m := smtp.NewServer(d, smtpCert, cfg.Server.Smtp.MaxMsgBytes)
-	go m.Serve(smtpListener)
-
 	handler := api.NewServer(d)
+	handler.SetAdminToken(cfg.Server.Http.AdminToken)
+
+	events := hub.NewHub()
+	m.SetHub(events)
+	handler.SetHub(events)
+	m.SetWebhooks(webhook.NewDispatcher(d, handler.MessagePayload))
+
+	if idx != nil {
+		m.SetSearchIndex(idx)
+		handler.SetSearchIndex(idx)
+	}
+
+	if mailRelay != nil {
+		m.SetRelay(mailRelay)
+		handler.SetRelay(mailRelay)
+	}
+
+	if oidcLogin != nil {
+		handler.SetOidc(oidcLogin)
+	}
+
+	go reapExpired(d)
+	go m.Serve(smtpListener)
 	h := &http.Server{Addr: cfg.Server.Http.Listen, Handler: handler}
 	if httpCert != nil {
 		h.TLSConfig = &tls.Config{Certificates: []tls.Certificate{*httpCert}}
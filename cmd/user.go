@@ -0,0 +1,344 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/spf13/cobra"
+	ent "github.com/supriyo-biswas/postbox/entities"
+	"github.com/supriyo-biswas/postbox/utils"
+	"gorm.io/gorm"
+)
+
+func findUser(d *gorm.DB, username string) (*ent.User, error) {
+	var user ent.User
+	err := d.Where("username = ?", username).First(&user).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("user %s not found", username)
+		}
+		return nil, fmt.Errorf("failed to query user: %s", err)
+	}
+
+	return &user, nil
+}
+
+// userPassword returns the password in the --password flag, or a random one
+// if it isn't set. The second return value is true for random passwords.
+func userPassword(cmd *cobra.Command) (string, bool, error) {
+	password, _ := cmd.Flags().GetString("password")
+	if password != "" {
+		return password, false, nil
+	}
+
+	password, err := utils.RandomString(12)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to generate password: %s", err)
+	}
+
+	return password, true, nil
+}
+
+func runUserAddCmd(cmd *cobra.Command, args []string) error {
+	cfg, err := readConfig(cmd.Root().PersistentFlags())
+	if err != nil {
+		return fmt.Errorf("failed to read config: %s", err)
+	}
+
+	d, err := openDb(cfg.Database.Path)
+	if err != nil {
+		return err
+	}
+
+	var count int64
+	if err := d.Model(&ent.User{}).Where("username = ?", args[0]).Count(&count).Error; err != nil {
+		return fmt.Errorf("failed to query user: %s", err)
+	}
+
+	if count > 0 {
+		return fmt.Errorf("user %s already exists", args[0])
+	}
+
+	password, random, err := userPassword(cmd)
+	if err != nil {
+		return err
+	}
+
+	hash, err := utils.HashPassword(password)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %s", err)
+	}
+
+	user := ent.User{Username: args[0], PasswordHash: hash}
+	if err := d.Create(&user).Error; err != nil {
+		return fmt.Errorf("failed to create user: %s", err)
+	}
+
+	fmt.Printf("User ID: %d\n", user.Id)
+	if random {
+		fmt.Printf("Password: %s\n", password)
+	}
+
+	return nil
+}
+
+func runUserListCmd(cmd *cobra.Command, args []string) error {
+	cfg, err := readConfig(cmd.Root().PersistentFlags())
+	if err != nil {
+		return fmt.Errorf("failed to read config: %s", err)
+	}
+
+	d, err := openDb(cfg.Database.Path)
+	if err != nil {
+		return err
+	}
+
+	var users []ent.User
+	if err := d.Order("username").Find(&users).Error; err != nil {
+		return fmt.Errorf("failed to query users: %s", err)
+	}
+
+	for _, user := range users {
+		var rows []struct {
+			Name string
+			Role ent.MembershipRole
+		}
+
+		err := d.Model(&ent.Membership{}).
+			Select("inboxes.name, memberships.role").
+			Joins("JOIN inboxes ON inboxes.id = memberships.inbox_id").
+			Where("memberships.user_id = ?", user.Id).
+			Order("inboxes.name").
+			Scan(&rows).Error
+		if err != nil {
+			return fmt.Errorf("failed to query memberships: %s", err)
+		}
+
+		if user.OidcSubject != nil {
+			fmt.Printf("%s\t(oidc)\n", user.Username)
+		} else {
+			fmt.Println(user.Username)
+		}
+
+		for _, row := range rows {
+			fmt.Printf("\t%s\t%s\n", row.Name, row.Role)
+		}
+	}
+
+	return nil
+}
+
+func runUserRemoveCmd(cmd *cobra.Command, args []string) error {
+	cfg, err := readConfig(cmd.Root().PersistentFlags())
+	if err != nil {
+		return fmt.Errorf("failed to read config: %s", err)
+	}
+
+	d, err := openDb(cfg.Database.Path)
+	if err != nil {
+		return err
+	}
+
+	user, err := findUser(d, args[0])
+	if err != nil {
+		return err
+	}
+
+	if err := d.Delete(user).Error; err != nil {
+		return fmt.Errorf("failed to delete user: %s", err)
+	}
+
+	return nil
+}
+
+func runUserPasswdCmd(cmd *cobra.Command, args []string) error {
+	cfg, err := readConfig(cmd.Root().PersistentFlags())
+	if err != nil {
+		return fmt.Errorf("failed to read config: %s", err)
+	}
+
+	d, err := openDb(cfg.Database.Path)
+	if err != nil {
+		return err
+	}
+
+	user, err := findUser(d, args[0])
+	if err != nil {
+		return err
+	}
+
+	password, random, err := userPassword(cmd)
+	if err != nil {
+		return err
+	}
+
+	if user.PasswordHash, err = utils.HashPassword(password); err != nil {
+		return fmt.Errorf("failed to hash password: %s", err)
+	}
+
+	// log the user out everywhere, in case the old password was leaked
+	err = d.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(user).Error; err != nil {
+			return err
+		}
+
+		return tx.Where("user_id = ?", user.Id).Delete(&ent.Session{}).Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update user: %s", err)
+	}
+
+	if random {
+		fmt.Printf("Password: %s\n", password)
+	}
+
+	return nil
+}
+
+func runUserGrantCmd(cmd *cobra.Command, args []string) error {
+	cfg, err := readConfig(cmd.Root().PersistentFlags())
+	if err != nil {
+		return fmt.Errorf("failed to read config: %s", err)
+	}
+
+	role, _ := cmd.Flags().GetString("role")
+	if !slices.Contains(ent.MembershipRoles, ent.MembershipRole(role)) {
+		return fmt.Errorf("invalid role %s", role)
+	}
+
+	d, err := openDb(cfg.Database.Path)
+	if err != nil {
+		return err
+	}
+
+	user, err := findUser(d, args[0])
+	if err != nil {
+		return err
+	}
+
+	inbox, err := findInbox(d, args[1])
+	if err != nil {
+		return err
+	}
+
+	membership := ent.Membership{
+		UserId:  user.Id,
+		InboxId: inbox.Id,
+		Role:    ent.MembershipRole(role),
+	}
+
+	// granting a role to an existing member changes their role
+	err = d.Where("user_id = ? AND inbox_id = ?", user.Id, inbox.Id).
+		Assign(ent.Membership{Role: membership.Role}).
+		FirstOrCreate(&membership).Error
+	if err != nil {
+		return fmt.Errorf("failed to add membership: %s", err)
+	}
+
+	return nil
+}
+
+func runUserRevokeCmd(cmd *cobra.Command, args []string) error {
+	cfg, err := readConfig(cmd.Root().PersistentFlags())
+	if err != nil {
+		return fmt.Errorf("failed to read config: %s", err)
+	}
+
+	d, err := openDb(cfg.Database.Path)
+	if err != nil {
+		return err
+	}
+
+	user, err := findUser(d, args[0])
+	if err != nil {
+		return err
+	}
+
+	inbox, err := findInbox(d, args[1])
+	if err != nil {
+		return err
+	}
+
+	tx := d.Where("user_id = ? AND inbox_id = ?", user.Id, inbox.Id).Delete(&ent.Membership{})
+	if tx.Error != nil {
+		return fmt.Errorf("failed to delete membership: %s", tx.Error)
+	}
+
+	if tx.RowsAffected == 0 {
+		return fmt.Errorf("user %s is not a member of inbox %s", args[0], args[1])
+	}
+
+	return nil
+}
+
+var userCmd = &cobra.Command{
+	Use:   "user",
+	Short: "Manage users of the web interface",
+}
+
+var userAddCmd = &cobra.Command{
+	Use:          "add username",
+	Aliases:      []string{"create"},
+	Short:        "Add a user",
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE:         runUserAddCmd,
+}
+
+var userListCmd = &cobra.Command{
+	Use:          "list",
+	Aliases:      []string{"ls"},
+	Short:        "List users and the inboxes they are members of",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE:         runUserListCmd,
+}
+
+var userRemoveCmd = &cobra.Command{
+	Use:          "remove username",
+	Aliases:      []string{"rm", "delete"},
+	Short:        "Delete a user",
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE:         runUserRemoveCmd,
+}
+
+var userPasswdCmd = &cobra.Command{
+	Use:          "passwd username",
+	Short:        "Change a user's password, and log them out",
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE:         runUserPasswdCmd,
+}
+
+var userGrantCmd = &cobra.Command{
+	Use:          "grant username inbox",
+	Short:        "Make a user a member of an inbox, or change their role in it",
+	Args:         cobra.ExactArgs(2),
+	SilenceUsage: true,
+	RunE:         runUserGrantCmd,
+}
+
+var userRevokeCmd = &cobra.Command{
+	Use:          "revoke username inbox",
+	Short:        "Remove a user from an inbox",
+	Args:         cobra.ExactArgs(2),
+	SilenceUsage: true,
+	RunE:         runUserRevokeCmd,
+}
+
+func init() {
+	for _, c := range []*cobra.Command{userAddCmd, userPasswdCmd} {
+		c.Flags().StringP("password", "p", "", "Password of the user (default: a random password)")
+	}
+
+	userGrantCmd.Flags().String("role", string(ent.RoleViewer), "Role of the user in the inbox (viewer, editor, owner)")
+
+	userCmd.AddCommand(userAddCmd)
+	userCmd.AddCommand(userListCmd)
+	userCmd.AddCommand(userRemoveCmd)
+	userCmd.AddCommand(userPasswdCmd)
+	userCmd.AddCommand(userGrantCmd)
+	userCmd.AddCommand(userRevokeCmd)
+}
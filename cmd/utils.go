@@ -10,6 +10,7 @@ import (
 	"path"
 
 	ent "github.com/supriyo-biswas/postbox/entities"
+	"github.com/supriyo-biswas/postbox/fts"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
@@ -18,8 +19,17 @@ import (
 const dbOptions = "?_journal_mode=WAL&_foreign_keys=true"
 
 func openDb(dir string) (*gorm.DB, error) {
+	d, _, err := openDbWithIndex(dir)
+	return d, err
+}
+
+// openDbWithIndex opens the database and its full-text search index, which
+// is nil if the build doesn't support full-text search. openDb opens the
+// index as well, since a build without full-text search can't delete the
+// messages of a database indexed by one with it until fts.Open adjusts it.
+func openDbWithIndex(dir string) (*gorm.DB, *fts.Index, error) {
 	if err := os.MkdirAll(dir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create storage directory: %s", err)
+		return nil, nil, fmt.Errorf("failed to create storage directory: %s", err)
 	}
 
 	dbPath := path.Join(dir, "db.sqlite3")
@@ -28,19 +38,36 @@ func openDb(dir string) (*gorm.DB, error) {
 	})
 
 	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %s", err)
+		return nil, nil, fmt.Errorf("failed to open database: %s", err)
 	}
 
 	if err := d.AutoMigrate(
+		&ent.Account{},
 		&ent.Inbox{},
 		&ent.Email{},
 		&ent.Address{},
 		&ent.EmailContent{},
+		&ent.ForwardRule{},
+		&ent.Delivery{},
+		&ent.CalendarEvent{},
+		&ent.InboxKey{},
+		&ent.CodePattern{},
+		&ent.Webhook{},
+		&ent.WebhookDelivery{},
+		&ent.ApiKey{},
+		&ent.User{},
+		&ent.Session{},
+		&ent.Membership{},
 	); err != nil {
-		return nil, fmt.Errorf("failed to run migrations: %s", err)
+		return nil, nil, fmt.Errorf("failed to run migrations: %s", err)
+	}
+
+	idx, err := fts.Open(d)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open search index: %s", err)
 	}
 
-	return d, nil
+	return d, idx, nil
 }
 
 func newCredentials(file string) (*CredentialConfig, error) {
@@ -0,0 +1,297 @@
+package dkim
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	AlgoRSASHA256     = "rsa-sha256"
+	AlgoEd25519SHA256 = "ed25519-sha256"
+)
+
+var ErrUnsupportedKey = errors.New("unsupported DKIM key type")
+var ErrMissingFrom = errors.New("message has no From header")
+
+var DefaultHeaders = []string{
+	"From",
+	"Reply-To",
+	"Subject",
+	"Date",
+	"To",
+	"Cc",
+	"Message-ID",
+	"In-Reply-To",
+	"References",
+	"MIME-Version",
+	"Content-Type",
+	"Content-Transfer-Encoding",
+}
+
+// Signer adds DKIM-Signature headers to messages using relaxed/relaxed
+// canonicalization, as described in RFC 6376 and RFC 8463.
+type Signer struct {
+	domain   string
+	selector string
+	key      crypto.Signer
+	algo     string
+	headers  []string
+}
+
+func NewSigner(domain, selector string, key crypto.Signer, headers []string) (*Signer, error) {
+	var algo string
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		algo = AlgoRSASHA256
+	case ed25519.PrivateKey:
+		algo = AlgoEd25519SHA256
+	default:
+		return nil, ErrUnsupportedKey
+	}
+
+	if len(headers) == 0 {
+		headers = DefaultHeaders
+	}
+
+	return &Signer{domain, selector, key, algo, headers}, nil
+}
+
+// LoadPrivateKey reads a PEM encoded RSA (PKCS #1 or PKCS #8) or Ed25519
+// (PKCS #8) private key.
+func LoadPrivateKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		switch k := key.(type) {
+		case *rsa.PrivateKey:
+			return k, nil
+		case ed25519.PrivateKey:
+			return k, nil
+		}
+	}
+
+	return nil, ErrUnsupportedKey
+}
+
+func (s *Signer) Algorithm() string {
+	return s.algo
+}
+
+// Sign returns a copy of the message with a DKIM-Signature header prepended.
+// Bare LF line endings are converted to CRLF first, since that is how the
+// message will be transmitted over SMTP.
+func (s *Signer) Sign(message []byte) ([]byte, error) {
+	message = normalizeLineEndings(message)
+	header, body := splitMessage(message)
+	fields := parseHeaderFields(header)
+
+	var signed []string
+	var canonHeaders bytes.Buffer
+	used := make(map[string]int)
+	hasFrom := false
+
+	for _, name := range s.headers {
+		key := strings.ToLower(name)
+		field := findField(fields, key, used[key])
+		if field == nil {
+			continue
+		}
+
+		used[key]++
+		hasFrom = hasFrom || key == "from"
+		signed = append(signed, name)
+		canonHeaders.WriteString(canonicalizeHeader(field.name, field.value))
+		canonHeaders.WriteString("\r\n")
+	}
+
+	if !hasFrom {
+		return nil, ErrMissingFrom
+	}
+
+	bodyHash := sha256.Sum256(canonicalizeBody(body))
+	prefix := fmt.Sprintf("v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s;\r\n\tt=%s; h=%s;\r\n\tbh=%s;\r\n\tb=",
+		s.algo, s.domain, s.selector, strconv.FormatInt(time.Now().Unix(), 10),
+		strings.Join(signed, ":"), base64.StdEncoding.EncodeToString(bodyHash[:]))
+
+	canonHeaders.WriteString(canonicalizeHeader("DKIM-Signature", prefix))
+	digest := sha256.Sum256(canonHeaders.Bytes())
+
+	var sig []byte
+	var err error
+	if s.algo == AlgoEd25519SHA256 {
+		sig, err = s.key.Sign(rand.Reader, digest[:], crypto.Hash(0))
+	} else {
+		sig, err = s.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var result bytes.Buffer
+	result.WriteString("DKIM-Signature: ")
+	result.WriteString(prefix)
+	result.WriteString(foldBase64(base64.StdEncoding.EncodeToString(sig)))
+	result.WriteString("\r\n")
+	result.Write(message)
+
+	return result.Bytes(), nil
+}
+
+type headerField struct {
+	name  string
+	value string
+}
+
+func normalizeLineEndings(data []byte) []byte {
+	if !bytes.Contains(data, []byte("\n")) {
+		return data
+	}
+
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+}
+
+func splitMessage(message []byte) ([]byte, []byte) {
+	if bytes.HasPrefix(message, []byte("\r\n")) {
+		return nil, message[2:]
+	}
+
+	if i := bytes.Index(message, []byte("\r\n\r\n")); i >= 0 {
+		return message[:i+2], message[i+4:]
+	}
+
+	return message, nil
+}
+
+func parseHeaderFields(header []byte) []headerField {
+	var fields []headerField
+	for _, line := range strings.SplitAfter(string(header), "\r\n") {
+		if line == "" {
+			continue
+		}
+
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].value += line
+			continue
+		}
+
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+
+		fields = append(fields, headerField{name, value})
+	}
+
+	for i := range fields {
+		fields[i].value = strings.TrimSuffix(fields[i].value, "\r\n")
+	}
+
+	return fields
+}
+
+// findField returns the n-th instance of a header counting from the bottom
+// of the header block, as required for signing repeated headers.
+func findField(fields []headerField, key string, n int) *headerField {
+	for i := len(fields) - 1; i >= 0; i-- {
+		if strings.ToLower(strings.TrimSpace(fields[i].name)) != key {
+			continue
+		}
+
+		if n == 0 {
+			return &fields[i]
+		}
+		n--
+	}
+
+	return nil
+}
+
+func collapseWhitespace(s string) string {
+	var b strings.Builder
+	space := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == ' ' || c == '\t' {
+			space = true
+			continue
+		}
+
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteByte(c)
+	}
+
+	if space {
+		b.WriteByte(' ')
+	}
+
+	return b.String()
+}
+
+func canonicalizeHeader(name, value string) string {
+	value = strings.ReplaceAll(value, "\r\n", "")
+	value = strings.TrimSpace(collapseWhitespace(value))
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + value
+}
+
+func canonicalizeBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(collapseWhitespace(line), " ")
+	}
+
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	if len(lines) == 0 {
+		return nil
+	}
+
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+func foldBase64(s string) string {
+	var b strings.Builder
+	for len(s) > 72 {
+		b.WriteString(s[:72])
+		b.WriteString("\r\n\t")
+		s = s[72:]
+	}
+
+	b.WriteString(s)
+	return b.String()
+}
@@ -1,6 +1,7 @@
 package entities
 
 import (
+	"strings"
 	"time"
 )
 
@@ -21,31 +22,135 @@ const (
 	RelText     RelType = "text"
 	RelAttach   RelType = "attachment"
 	RelEmbedded RelType = "embedded"
+
+	// RelHTMLText is a plain text rendering of the HTML body, which is saved
+	// when the message doesn't have a text body
+	RelHTMLText RelType = "html_text"
+)
+
+type ApiKeyScope string
+
+const (
+	ScopeRead  ApiKeyScope = "read"
+	ScopeWrite ApiKeyScope = "write"
+	ScopeAdmin ApiKeyScope = "admin"
+)
+
+// ApiKeyScopes has every API key scope. The read scope allows reading an
+// inbox and its messages, the write scope allows changing and deleting them,
+// and the admin scope allows managing the inbox's forward rules, code
+// patterns and webhooks.
+var ApiKeyScopes = []ApiKeyScope{ScopeRead, ScopeWrite, ScopeAdmin}
+
+// MembershipRole is the role of a user in an inbox. Viewers can read the
+// inbox, editors can also change and delete its messages, and owners can
+// manage its forward rules, code patterns and webhooks as well.
+type MembershipRole string
+
+const (
+	RoleViewer MembershipRole = "viewer"
+	RoleEditor MembershipRole = "editor"
+	RoleOwner  MembershipRole = "owner"
+)
+
+var MembershipRoles = []MembershipRole{RoleViewer, RoleEditor, RoleOwner}
+
+// Allows reports whether a role allows the requests that need an API key
+// scope.
+func (r MembershipRole) Allows(scope ApiKeyScope) bool {
+	switch r {
+	case RoleOwner:
+		return true
+	case RoleEditor:
+		return scope == ScopeRead || scope == ScopeWrite
+	case RoleViewer:
+		return scope == ScopeRead
+	}
+
+	return false
+}
+
+type DeliveryStatus string
+
+const (
+	DeliverySent   DeliveryStatus = "sent"
+	DeliveryFailed DeliveryStatus = "failed"
 )
 
+// TemporaryInboxPrefix is the prefix of the random names given to temporary
+// inboxes that are created without a name.
+const TemporaryInboxPrefix = "tmp-"
+
+// Account owns a set of inboxes, which can all be accessed with the
+// account's token.
+type Account struct {
+	Id        int64  `gorm:"primaryKey;not null"`
+	Name      string `gorm:"unique;not null"`
+	TokenHash string `gorm:"index;not null"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
 type Inbox struct {
-	Id        int64   `gorm:"primaryKey;not null"`
+	Id int64 `gorm:"primaryKey;not null"`
+
+	// AccountId is the account that owns the inbox, if any. It isn't a
+	// foreign key, since adding one makes SQLite recreate the inboxes table,
+	// which deletes the rows that reference it; it is cleared when the
+	// account is deleted instead.
+	AccountId *int64 `gorm:"index"`
+
 	Name      string  `gorm:"unique;not null"`
 	SmtpPass  string  `gorm:"not null"`
 	ApiKey    string  `gorm:"not null"`
 	Emails    []Email `gorm:"constraint:OnDelete:CASCADE;"`
 	CreatedAt time.Time
 	UpdatedAt time.Time
+
+	// ExpiresAt is the time after which a temporary inbox is deleted
+	ExpiresAt *time.Time `gorm:"index"`
+
+	ForwardRules []ForwardRule `gorm:"constraint:OnDelete:CASCADE;"`
+	Keys         []InboxKey    `gorm:"constraint:OnDelete:CASCADE;"`
+	CodePatterns []CodePattern `gorm:"constraint:OnDelete:CASCADE;"`
+	Webhooks     []Webhook     `gorm:"constraint:OnDelete:CASCADE;"`
+	ApiKeys      []ApiKey      `gorm:"constraint:OnDelete:CASCADE;"`
+	Memberships  []Membership  `gorm:"constraint:OnDelete:CASCADE;"`
+}
+
+// Expired reports whether an inbox is temporary and past its expiry time.
+// Expired inboxes are treated as if they don't exist until they're deleted.
+func (i *Inbox) Expired() bool {
+	return i.ExpiresAt != nil && !i.ExpiresAt.After(time.Now())
 }
 
 type Email struct {
-	Id          int64          `gorm:"primaryKey;not null"`
-	InboxId     int64          `gorm:"index;not null"`
-	ClientIP    string         `gorm:"not null"`
-	IsRead      bool           `gorm:"not null"`
-	ParseError  bool           `gorm:"not null"`
-	MailFrom    string         `gorm:"not null"`
-	Subject     string         `gorm:"not null"`
-	HeadersJson []byte         `gorm:"not null"`
-	Addresses   []Address      `gorm:"constraint:OnDelete:CASCADE;"`
-	Contents    []EmailContent `gorm:"constraint:OnDelete:CASCADE;"`
-	CreatedAt   time.Time      `gorm:"not null"`
-	UpdatedAt   time.Time      `gorm:"not null"`
+	Id      int64 `gorm:"primaryKey;not null"`
+	InboxId int64 `gorm:"index;not null"`
+
+	// ParentId is the email that this one is embedded in, if any. Like
+	// Inbox.AccountId, it isn't a foreign key, since adding one makes SQLite
+	// recreate the emails table; embedded emails are deleted along with
+	// their parent instead.
+	ParentId *int64 `gorm:"index"`
+
+	ClientIP       string          `gorm:"not null"`
+	IsRead         bool            `gorm:"not null"`
+	ParseError     bool            `gorm:"not null"`
+	Security       string          `gorm:"not null;default:''"`
+	Signature      string          `gorm:"not null;default:''"`
+	Signer         string          `gorm:"not null;default:''"`
+	Encryption     string          `gorm:"not null;default:''"`
+	SecurityError  string          `gorm:"not null;default:''"`
+	MailFrom       string          `gorm:"not null"`
+	Subject        string          `gorm:"not null"`
+	HeadersJson    []byte          `gorm:"not null"`
+	Addresses      []Address       `gorm:"constraint:OnDelete:CASCADE;"`
+	Contents       []EmailContent  `gorm:"constraint:OnDelete:CASCADE;"`
+	Deliveries     []Delivery      `gorm:"constraint:OnDelete:CASCADE;"`
+	CalendarEvents []CalendarEvent `gorm:"constraint:OnDelete:CASCADE;"`
+	CreatedAt      time.Time       `gorm:"not null"`
+	UpdatedAt      time.Time       `gorm:"not null"`
 }
 
 type Address struct {
@@ -61,6 +166,176 @@ type EmailContent struct {
 	EmailId      int64   `gorm:"not null"`
 	Content      []byte  `gorm:"not null"`
 	MimeType     string  `gorm:"not null"`
+	Charset      string  `gorm:"not null;default:''"`
+	ContentId    string  `gorm:"not null;default:''"`
 	FileName     string  `gorm:"not null"`
 	Size         int     `gorm:"not null"`
 }
+
+type ForwardRule struct {
+	Id           int64  `gorm:"primaryKey;not null"`
+	InboxId      int64  `gorm:"index;not null"`
+	Recipient    string `gorm:"not null"`
+	MatchFrom    string `gorm:"not null"`
+	MatchTo      string `gorm:"not null"`
+	MatchSubject string `gorm:"not null"`
+	CreatedAt    time.Time
+}
+
+// CodePattern is a regular expression that matches the one-time codes sent
+// to an inbox. The code is the first capturing group, or the whole match if
+// there are no groups.
+type CodePattern struct {
+	Id        int64  `gorm:"primaryKey;not null"`
+	InboxId   int64  `gorm:"index;not null"`
+	Pattern   string `gorm:"not null"`
+	CreatedAt time.Time
+}
+
+// Webhook is a URL that is sent the messages received by an inbox. Requests
+// are signed with an HMAC of the body keyed by the secret.
+type Webhook struct {
+	Id         int64             `gorm:"primaryKey;not null"`
+	InboxId    int64             `gorm:"index;not null"`
+	URL        string            `gorm:"not null"`
+	Secret     string            `gorm:"not null"`
+	Deliveries []WebhookDelivery `gorm:"constraint:OnDelete:CASCADE;"`
+	CreatedAt  time.Time
+}
+
+// WebhookDelivery records one attempt at sending a message to a webhook.
+// StatusCode is zero if no response was received.
+type WebhookDelivery struct {
+	Id         int64          `gorm:"primaryKey;not null"`
+	WebhookId  int64          `gorm:"index;not null"`
+	EmailId    int64          `gorm:"not null"`
+	Attempt    int            `gorm:"not null"`
+	StatusCode int            `gorm:"not null"`
+	Status     DeliveryStatus `gorm:"not null"`
+	Error      string         `gorm:"not null"`
+	CreatedAt  time.Time      `gorm:"not null"`
+}
+
+type Delivery struct {
+	Id        int64          `gorm:"primaryKey;not null"`
+	EmailId   int64          `gorm:"index;not null"`
+	RuleId    *int64         `gorm:"index"`
+	Recipient string         `gorm:"not null"`
+	Status    DeliveryStatus `gorm:"not null"`
+	Error     string         `gorm:"not null"`
+	CreatedAt time.Time      `gorm:"not null"`
+}
+
+type CalendarEvent struct {
+	Id             int64  `gorm:"primaryKey;not null"`
+	EmailId        int64  `gorm:"index;not null"`
+	Method         string `gorm:"not null"`
+	Uid            string `gorm:"index;not null"`
+	Sequence       int    `gorm:"not null"`
+	RecurrenceId   string `gorm:"not null"`
+	Summary        string `gorm:"not null"`
+	Description    string `gorm:"not null"`
+	Location       string `gorm:"not null"`
+	Status         string `gorm:"not null"`
+	OrganizerEmail string `gorm:"not null"`
+	OrganizerName  string `gorm:"not null"`
+	AttendeesJson  []byte `gorm:"not null"`
+	StartsAt       *time.Time
+	EndsAt         *time.Time
+	AllDay         bool   `gorm:"not null"`
+	TimeZone       string `gorm:"not null"`
+	RRule          string `gorm:"not null"`
+}
+
+// CalendarAttendee is the form in which attendees are stored in
+// CalendarEvent.AttendeesJson
+type CalendarAttendee struct {
+	Email    string `json:"email"`
+	Name     string `json:"name"`
+	Role     string `json:"role"`
+	PartStat string `json:"partstat"`
+	RSVP     bool   `json:"rsvp"`
+}
+
+// InboxKey is a PEM encoded set of S/MIME certificates and private keys, or an
+// armored OpenPGP keyring, used to verify and decrypt the emails received by
+// an inbox.
+type InboxKey struct {
+	Id          int64     `gorm:"primaryKey;not null"`
+	InboxId     int64     `gorm:"index;not null"`
+	Type        string    `gorm:"not null"`
+	Private     bool      `gorm:"not null"`
+	Description string    `gorm:"not null"`
+	Data        []byte    `gorm:"not null"`
+	CreatedAt   time.Time `gorm:"not null"`
+}
+
+// ApiKey is an additional API key of an inbox, which only allows the
+// requests in its scopes. Scopes is a comma-separated list of ApiKeyScope
+// values.
+type ApiKey struct {
+	Id         int64  `gorm:"primaryKey;not null"`
+	InboxId    int64  `gorm:"uniqueIndex:idx_api_keys_inbox_name;not null"`
+	Name       string `gorm:"uniqueIndex:idx_api_keys_inbox_name;not null"`
+	KeyHash    string `gorm:"index;not null"`
+	Scopes     string `gorm:"not null"`
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+	CreatedAt  time.Time `gorm:"not null"`
+}
+
+// HasScope reports whether an API key has a scope.
+func (k *ApiKey) HasScope(scope ApiKeyScope) bool {
+	for _, s := range strings.Split(k.Scopes, ",") {
+		if ApiKeyScope(s) == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Expired reports whether an API key has an expiry time that has passed.
+func (k *ApiKey) Expired() bool {
+	return k.ExpiresAt != nil && !k.ExpiresAt.After(time.Now())
+}
+
+// User is a user of the web interface, who can access the inboxes they are
+// members of. Users that log in with OIDC have the subject of their identity
+// at the provider, and no password.
+type User struct {
+	Id           int64        `gorm:"primaryKey;not null"`
+	Username     string       `gorm:"unique;not null"`
+	PasswordHash string       `gorm:"not null"`
+	OidcSubject  *string      `gorm:"uniqueIndex"`
+	Sessions     []Session    `gorm:"constraint:OnDelete:CASCADE;"`
+	Memberships  []Membership `gorm:"constraint:OnDelete:CASCADE;"`
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// Session is a login session of a user in the web interface. InboxId is the
+// inbox the user is viewing, if they have chosen one; it isn't a foreign key,
+// and may refer to an inbox they can no longer access.
+type Session struct {
+	Id        int64  `gorm:"primaryKey;not null"`
+	UserId    int64  `gorm:"index;not null"`
+	TokenHash string `gorm:"uniqueIndex;not null"`
+	CsrfToken string `gorm:"not null"`
+	InboxId   *int64
+	ExpiresAt time.Time `gorm:"index;not null"`
+	CreatedAt time.Time `gorm:"not null"`
+}
+
+// Expired reports whether a session has expired.
+func (s *Session) Expired() bool {
+	return !s.ExpiresAt.After(time.Now())
+}
+
+// Membership gives a user a role in an inbox.
+type Membership struct {
+	UserId    int64          `gorm:"primaryKey;not null"`
+	InboxId   int64          `gorm:"primaryKey;index;not null"`
+	Role      MembershipRole `gorm:"not null"`
+	CreatedAt time.Time      `gorm:"not null"`
+}
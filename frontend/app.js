@@ -12,7 +12,22 @@ Alpine.store('g', {
   }
 })
 
-const api = ky.create({ prefixUrl: '/web/api' })
+// csrfToken is the CSRF token of the user's session, which is sent with
+// every request that changes something; it is null with basic auth
+let csrfToken = null
+
+const api = ky.create({
+  prefixUrl: '/web/api',
+  hooks: {
+    beforeRequest: [
+      request => {
+        if (csrfToken && !['GET', 'HEAD'].includes(request.method)) {
+          request.headers.set('X-CSRF-Token', csrfToken)
+        }
+      }
+    ]
+  }
+})
 
 async function getUserInfo () {
   const response = await api.get('info')
@@ -127,5 +142,98 @@ document.addEventListener('deletemessages', async () => {
   }
 })
 
-getUserInfo().then(loadMessages).catch(handleError)
+let events = null
+
+function connectEvents () {
+  if (events) {
+    events.close()
+  }
+
+  events = new EventSource('/web/api/events')
+  for (const type of ['message_created', 'message_updated', 'message_deleted', 'inbox_cleaned', 'inbox_updated']) {
+    events.addEventListener(type, () => dispatch('inboxchanged'))
+  }
+}
+
+async function openInbox () {
+  await getUserInfo()
+  await loadMessages()
+  connectEvents()
+}
+
+async function startSession (session) {
+  csrfToken = session.csrf_token
+  const inboxes = await api.get('inboxes').json()
+  dispatch('sessionstarted', { username: session.username, inboxId: session.inbox_id, inboxes })
+
+  if (session.inbox_id === null) {
+    dispatch('noinboxes')
+    return
+  }
+
+  await openInbox()
+}
+
+// requireLogin shows the login form, with a button for single sign-on if it
+// is set up
+async function requireLogin (error = '') {
+  const options = await api.get('login').json()
+  dispatch('loginrequired', { error, oidc: options.oidc })
+}
+
+async function start () {
+  const response = await api.get('session', { throwHttpErrors: false })
+  if (response.ok) {
+    await startSession(await response.json())
+    return
+  }
+
+  // without a session, fall back to basic auth, which the browser asks for
+  // until users are added or single sign-on is set up
+  const info = await api.get('info', { throwHttpErrors: false })
+  if (info.status === 401) {
+    await requireLogin()
+    return
+  }
+
+  await openInbox()
+}
+
+document.addEventListener('login', async event => {
+  try {
+    const response = await api.post('login', { json: event.detail, throwHttpErrors: false })
+    if (response.status === 401) {
+      await requireLogin('Invalid username or password')
+      return
+    }
+
+    if (!response.ok) {
+      throw new Error(`failed to log in (${response.status})`)
+    }
+
+    await startSession(await response.json())
+  } catch (e) {
+    handleError(e)
+  }
+})
+
+document.addEventListener('logout', async () => {
+  try {
+    await api.post('logout')
+    window.location.reload()
+  } catch (e) {
+    handleError(e)
+  }
+})
+
+document.addEventListener('switchinbox', async event => {
+  try {
+    await api.patch('session', { json: { inbox_id: event.detail } })
+    await openInbox()
+  } catch (e) {
+    handleError(e)
+  }
+})
+
+start().catch(handleError)
 document.addEventListener('loadmessages', loadMessages)
@@ -0,0 +1,210 @@
+package fts
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"strings"
+	"unicode"
+
+	ent "github.com/supriyo-biswas/postbox/entities"
+	"github.com/supriyo-biswas/postbox/parsemail"
+	"gorm.io/gorm"
+)
+
+const (
+	rebuildBatchSize = 500
+
+	// snippet markers, which are replaced by <mark> tags after the snippet
+	// text is escaped
+	markStart = "\x02"
+	markEnd   = "\x03"
+)
+
+// Index is the full-text index of the messages of all inboxes. It is an FTS5
+// table with the subject, addresses, text body and the plain text rendering
+// of the HTML body of every message that isn't embedded in another one. Rows
+// are added by the SMTP server, and removed by a trigger when messages are
+// deleted.
+type Index struct {
+	db *gorm.DB
+}
+
+// Available reports whether SQLite was built with FTS5, which requires
+// building postbox with the sqlite_fts5 tag.
+func Available(db *gorm.DB) (bool, error) {
+	var used int
+	err := db.Raw("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&used).Error
+	return used == 1, err
+}
+
+// Open creates the index if it doesn't exist, and returns nil if FTS5 isn't
+// available. In that case, the trigger that removes deleted messages from the
+// index is dropped, as it can't run without FTS5; the index is then rebuilt
+// the next time it is opened with FTS5.
+func Open(db *gorm.DB) (*Index, error) {
+	ok, err := Available(db)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, db.Exec("DROP TRIGGER IF EXISTS emails_fts_delete").Error
+	}
+
+	var triggers int64
+	err = db.Raw(
+		"SELECT count(*) FROM sqlite_master WHERE type = 'trigger' AND name = 'emails_fts_delete'",
+	).Scan(&triggers).Error
+	if err != nil {
+		return nil, err
+	}
+
+	stmts := []string{
+		`CREATE VIRTUAL TABLE IF NOT EXISTS emails_fts USING fts5(
+			subject, addresses, text, html, tokenize = 'unicode61 remove_diacritics 2'
+		)`,
+		`CREATE TRIGGER IF NOT EXISTS emails_fts_delete AFTER DELETE ON emails BEGIN
+			DELETE FROM emails_fts WHERE rowid = old.id;
+		END`,
+	}
+
+	for _, stmt := range stmts {
+		if err := db.Exec(stmt).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	idx := &Index{db: db}
+	if triggers == 0 {
+		log.Printf("rebuilding full-text search index")
+		if err := idx.Rebuild(); err != nil {
+			return nil, fmt.Errorf("failed to rebuild full-text search index: %s", err)
+		}
+	}
+
+	return idx, nil
+}
+
+// Add indexes an email. The email must have its addresses and contents
+// loaded.
+func (i *Index) Add(email *ent.Email) error {
+	return i.add(i.db, email)
+}
+
+func (i *Index) add(db *gorm.DB, email *ent.Email) error {
+	addrs := make([]string, len(email.Addresses))
+	for j, a := range email.Addresses {
+		addrs[j] = strings.TrimSpace(a.Name + " " + a.Address)
+	}
+
+	var text, htmlText string
+	for _, c := range email.Contents {
+		switch c.Relationship {
+		case ent.RelText:
+			text = string(c.Content)
+		case ent.RelHTML:
+			htmlText = parsemail.HTMLToText(string(c.Content))
+		}
+	}
+
+	if err := db.Exec("DELETE FROM emails_fts WHERE rowid = ?", email.Id).Error; err != nil {
+		return err
+	}
+
+	return db.Exec(
+		"INSERT INTO emails_fts (rowid, subject, addresses, text, html) VALUES (?, ?, ?, ?, ?)",
+		email.Id, email.Subject, strings.Join(addrs, ", "), text, htmlText,
+	).Error
+}
+
+// Rebuild clears the index, and indexes every email in the database.
+func (i *Index) Rebuild() error {
+	return i.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("DELETE FROM emails_fts").Error; err != nil {
+			return err
+		}
+
+		var emails []ent.Email
+		return tx.Preload("Addresses").
+			Preload("Contents", "relationship IN ?", []ent.RelType{ent.RelText, ent.RelHTML}).
+			Where("parent_id IS NULL").
+			FindInBatches(&emails, rebuildBatchSize, func(batch *gorm.DB, _ int) error {
+				for _, email := range emails {
+					if err := i.add(tx, &email); err != nil {
+						return err
+					}
+				}
+				return nil
+			}).Error
+	})
+}
+
+// Query returns an FTS5 query that matches text containing all the words in
+// s, or words starting with them. It returns an empty string if s has no
+// words.
+func Query(s string) string {
+	var phrases []string
+	for _, word := range strings.Fields(s) {
+		if strings.IndexFunc(word, isWordChar) < 0 {
+			continue
+		}
+
+		phrases = append(phrases, `"`+strings.ReplaceAll(word, `"`, `""`)+`"*`)
+	}
+
+	return strings.Join(phrases, " ")
+}
+
+// BodyQuery is like Query, but only matches the bodies.
+func BodyQuery(s string) string {
+	q := Query(s)
+	if q == "" {
+		return ""
+	}
+
+	return "{text html} : (" + q + ")"
+}
+
+func isWordChar(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r)
+}
+
+// Match returns a condition on the emails table that matches an FTS5 query.
+func (i *Index) Match(query string) (string, []any) {
+	return "id IN (SELECT rowid FROM emails_fts WHERE emails_fts MATCH ?)", []any{query}
+}
+
+// Rank orders a query on the emails table by how well the emails match an
+// FTS5 query, best first. Emails that don't match it are excluded.
+func (i *Index) Rank(tx *gorm.DB, query string) *gorm.DB {
+	return tx.Joins(
+		"JOIN (SELECT rowid AS fts_id, rank AS fts_rank FROM emails_fts WHERE emails_fts MATCH ?) AS fts ON fts.fts_id = emails.id",
+		query,
+	).Order("fts.fts_rank")
+}
+
+// Snippets returns HTML snippets of the emails with the given ids, in which
+// the text that matches an FTS5 query is in <mark> tags.
+func (i *Index) Snippets(query string, ids []int64) (map[int64]string, error) {
+	var rows []struct {
+		Id      int64
+		Snippet string
+	}
+
+	err := i.db.Raw(
+		"SELECT rowid AS id, snippet(emails_fts, -1, ?, ?, '…', 16) AS snippet FROM emails_fts WHERE emails_fts MATCH ? AND rowid IN ?",
+		markStart, markEnd, query, ids,
+	).Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	replacer := strings.NewReplacer(markStart, "<mark>", markEnd, "</mark>")
+	snippets := make(map[int64]string, len(rows))
+	for _, row := range rows {
+		snippets[row.Id] = replacer.Replace(html.EscapeString(row.Snippet))
+	}
+
+	return snippets, nil
+}
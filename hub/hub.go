@@ -0,0 +1,77 @@
+package hub
+
+import "sync"
+
+// subscriberBuffer is the number of events that are queued for a subscriber
+// before further events are dropped
+const subscriberBuffer = 64
+
+const (
+	MessageCreated = "message_created"
+	MessageUpdated = "message_updated"
+	MessageDeleted = "message_deleted"
+	InboxCleaned   = "inbox_cleaned"
+	InboxUpdated   = "inbox_updated"
+)
+
+// Event is published when the messages of an inbox change. EmailId is zero
+// for the Inbox* events. Data is the payload of the event if the publisher has
+// it at hand, such as a message that was deleted; otherwise, subscribers are
+// expected to look up the message themselves.
+type Event struct {
+	Type    string
+	InboxId int64
+	EmailId int64
+	Data    any
+}
+
+type subscriber struct {
+	inbox int64
+	ch    chan Event
+}
+
+// Hub delivers the events published by the SMTP and API servers to the
+// clients of the API server that wait for or stream them. Publishing
+// never blocks: subscribers that don't keep up miss events, and should treat
+// an event as a signal to look for new messages rather than as a complete
+// list of them.
+type Hub struct {
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+}
+
+func NewHub() *Hub {
+	return &Hub{subscribers: map[*subscriber]struct{}{}}
+}
+
+// Subscribe returns a channel that receives the events of an inbox, and a
+// function that must be called to stop receiving them.
+func (h *Hub) Subscribe(inbox int64) (<-chan Event, func()) {
+	sub := &subscriber{inbox: inbox, ch: make(chan Event, subscriberBuffer)}
+
+	h.mu.Lock()
+	h.subscribers[sub] = struct{}{}
+	h.mu.Unlock()
+
+	return sub.ch, func() {
+		h.mu.Lock()
+		delete(h.subscribers, sub)
+		h.mu.Unlock()
+	}
+}
+
+func (h *Hub) Publish(e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subscribers {
+		if sub.inbox != e.InboxId {
+			continue
+		}
+
+		select {
+		case sub.ch <- e:
+		default:
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	requestTimeout = 10 * time.Second
+	maxBodyBytes   = 1024 * 1024
+)
+
+var DefaultScopes = []string{"openid", "profile", "email"}
+
+var ErrNoIdToken = errors.New("token response has no id_token")
+
+// discovery is the part of the provider metadata that is used for logging
+// in.
+type discovery struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JwksURI               string   `json:"jwks_uri"`
+	TokenAuthMethods      []string `json:"token_endpoint_auth_methods_supported"`
+}
+
+// Provider logs users in with the authorization code flow of an OpenID
+// Connect provider. Its metadata and keys are fetched when they are first
+// needed, so that the server can start while the provider is unreachable.
+type Provider struct {
+	issuer       string
+	clientId     string
+	clientSecret string
+	redirectURL  string
+	scopes       []string
+	client       *http.Client
+
+	mu        sync.Mutex
+	discovery *discovery
+	keys      *keySet
+}
+
+func NewProvider(issuer, clientId, clientSecret, redirectURL string, insecureSkipVerify bool) *Provider {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: insecureSkipVerify}
+
+	return &Provider{
+		issuer:       issuer,
+		clientId:     clientId,
+		clientSecret: clientSecret,
+		redirectURL:  redirectURL,
+		scopes:       DefaultScopes,
+		client:       &http.Client{Timeout: requestTimeout, Transport: transport},
+	}
+}
+
+// SetScopes overrides the scopes requested from the provider. The openid
+// scope is always requested.
+func (p *Provider) SetScopes(scopes []string) {
+	if len(scopes) == 0 {
+		return
+	}
+
+	if !slices.Contains(scopes, "openid") {
+		scopes = append([]string{"openid"}, scopes...)
+	}
+
+	p.scopes = scopes
+}
+
+func (p *Provider) getJSON(ctx context.Context, u string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Accept", "application/json")
+	return p.doJSON(req, v)
+}
+
+func (p *Provider) doJSON(req *http.Request, v any) error {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBodyBytes))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d: %s", req.URL, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	return json.Unmarshal(body, v)
+}
+
+func (p *Provider) getDiscovery(ctx context.Context) (*discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var d discovery
+	u := strings.TrimSuffix(p.issuer, "/") + "/.well-known/openid-configuration"
+	if err := p.getJSON(ctx, u, &d); err != nil {
+		return nil, fmt.Errorf("failed to get provider metadata: %s", err)
+	}
+
+	if d.Issuer != p.issuer {
+		return nil, fmt.Errorf("provider metadata has issuer %q, expected %q", d.Issuer, p.issuer)
+	}
+
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JwksURI == "" {
+		return nil, errors.New("provider metadata is missing endpoints")
+	}
+
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+// codeChallenge returns the PKCE S256 challenge of a code verifier.
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL returns the URL at the provider that a user is sent to for
+// logging in. The state, nonce and code verifier must be kept by the caller
+// until the user returns, and passed to Exchange and Verify.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(d.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid authorization endpoint: %s", err)
+	}
+
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.clientId)
+	q.Set("redirect_uri", p.redirectURL)
+	q.Set("scope", strings.Join(p.scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", codeChallenge(verifier))
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+// Exchange redeems an authorization code at the token endpoint, and returns
+// the verified claims of the ID token in the response.
+func (p *Provider) Exchange(ctx context.Context, code, nonce, verifier string) (Claims, error) {
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.redirectURL)
+	form.Set("code_verifier", verifier)
+
+	// client_secret_basic is the default, but some providers only allow
+	// the credentials to be sent in the form
+	useBasic := p.clientSecret != "" && (len(d.TokenAuthMethods) == 0 ||
+		slices.Contains(d.TokenAuthMethods, "client_secret_basic"))
+
+	if !useBasic {
+		form.Set("client_id", p.clientId)
+		if p.clientSecret != "" {
+			form.Set("client_secret", p.clientSecret)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if useBasic {
+		req.SetBasicAuth(url.QueryEscape(p.clientId), url.QueryEscape(p.clientSecret))
+	}
+
+	var resp struct {
+		IdToken string `json:"id_token"`
+	}
+
+	if err := p.doJSON(req, &resp); err != nil {
+		return nil, fmt.Errorf("failed to redeem authorization code: %s", err)
+	}
+
+	if resp.IdToken == "" {
+		return nil, ErrNoIdToken
+	}
+
+	return p.Verify(ctx, resp.IdToken, nonce)
+}
@@ -0,0 +1,372 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// clockSkew is how far the clocks of the provider and postbox may
+	// differ when checking the times in ID tokens.
+	clockSkew = time.Minute
+
+	// keyRefreshInterval limits how often the provider's keys are fetched
+	// again when a token is signed by an unknown key.
+	keyRefreshInterval = 10 * time.Second
+)
+
+var (
+	ErrMalformedToken   = errors.New("malformed ID token")
+	ErrUnsupportedAlg   = errors.New("unsupported ID token signing algorithm")
+	ErrUnknownKey       = errors.New("ID token is signed by an unknown key")
+	ErrInvalidSignature = errors.New("invalid ID token signature")
+)
+
+// Claims are the claims of a verified ID token.
+type Claims map[string]any
+
+// String returns a claim if it is a string, and an empty string otherwise.
+func (c Claims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// Strings returns a claim that is either a string or a list of strings.
+func (c Claims) Strings(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		return []string{v}
+	case []any:
+		var result []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	}
+
+	return nil
+}
+
+func (c Claims) time(name string) (time.Time, bool) {
+	v, ok := c[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	return time.Unix(int64(v), 0), true
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type key struct {
+	kid string
+	alg string
+	pub crypto.PublicKey
+}
+
+type keySet struct {
+	keys      []key
+	fetchedAt time.Time
+}
+
+func decodeSegment(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func parseKey(k jwk) (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeSegment(k.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decodeSegment(k.E)
+		if err != nil {
+			return nil, err
+		}
+
+		exp := new(big.Int).SetBytes(e)
+		if !exp.IsInt64() || exp.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+
+		x, err := decodeSegment(k.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := decodeSegment(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		size := (curve.Params().BitSize + 7) / 8
+		if len(x) != size || len(y) != size {
+			return nil, errors.New("invalid EC point")
+		}
+
+		return ecdsa.ParseUncompressedPublicKey(curve, slices.Concat([]byte{4}, x, y))
+	}
+
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+func (p *Provider) fetchKeys(ctx context.Context) (*keySet, error) {
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+
+	if err := p.getJSON(ctx, d.JwksURI, &jwks); err != nil {
+		return nil, fmt.Errorf("failed to get provider keys: %s", err)
+	}
+
+	ks := &keySet{fetchedAt: time.Now()}
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		// keys that can't be used are skipped, rather than failing the
+		// login for tokens signed by the other keys
+		pub, err := parseKey(k)
+		if err != nil {
+			continue
+		}
+
+		ks.keys = append(ks.keys, key{kid: k.Kid, alg: k.Alg, pub: pub})
+	}
+
+	return ks, nil
+}
+
+// findKeys returns the keys that may have signed a token. The keys are
+// fetched again if none of them match, since the provider may have rotated
+// them.
+func (p *Provider) findKeys(ctx context.Context, kid, alg string) ([]key, error) {
+	match := func(ks *keySet) []key {
+		var result []key
+		for _, k := range ks.keys {
+			if (kid == "" || k.kid == kid) && (k.alg == "" || k.alg == alg) {
+				result = append(result, k)
+			}
+		}
+		return result
+	}
+
+	p.mu.Lock()
+	ks := p.keys
+	p.mu.Unlock()
+
+	if ks != nil {
+		if keys := match(ks); len(keys) > 0 || time.Since(ks.fetchedAt) < keyRefreshInterval {
+			return keys, nil
+		}
+	}
+
+	ks, err := p.fetchKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.keys = ks
+	p.mu.Unlock()
+
+	return match(ks), nil
+}
+
+func verifySignature(alg string, pub crypto.PublicKey, signed, sig []byte) error {
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	}
+
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch alg[:2] {
+	case "RS":
+		if pub, ok := pub.(*rsa.PublicKey); ok {
+			return rsa.VerifyPKCS1v15(pub, hash, digest, sig)
+		}
+	case "PS":
+		if pub, ok := pub.(*rsa.PublicKey); ok {
+			return rsa.VerifyPSS(pub, hash, digest, sig, nil)
+		}
+	case "ES":
+		if pub, ok := pub.(*ecdsa.PublicKey); ok {
+			size := (pub.Curve.Params().BitSize + 7) / 8
+			if len(sig) != 2*size {
+				return ErrInvalidSignature
+			}
+
+			r := new(big.Int).SetBytes(sig[:size])
+			s := new(big.Int).SetBytes(sig[size:])
+			if ecdsa.Verify(pub, digest, r, s) {
+				return nil
+			}
+		}
+	}
+
+	return ErrInvalidSignature
+}
+
+// Verify checks the signature of an ID token, and that it was issued by the
+// provider for this client, for the login with the given nonce.
+func (p *Provider) Verify(ctx context.Context, token, nonce string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformedToken
+	}
+
+	rawHeader, err := decodeSegment(parts[0])
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		return nil, ErrMalformedToken
+	}
+
+	switch header.Alg {
+	case "RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512":
+	default:
+		return nil, ErrUnsupportedAlg
+	}
+
+	sig, err := decodeSegment(parts[2])
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+
+	keys, err := p.findKeys(ctx, header.Kid, header.Alg)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(keys) == 0 {
+		return nil, ErrUnknownKey
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, k := range keys {
+		if verifySignature(header.Alg, k.pub, signed, sig) == nil {
+			verified = true
+			break
+		}
+	}
+
+	if !verified {
+		return nil, ErrInvalidSignature
+	}
+
+	payload, err := decodeSegment(parts[1])
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrMalformedToken
+	}
+
+	if err := p.checkClaims(claims, nonce); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+func (p *Provider) checkClaims(claims Claims, nonce string) error {
+	if iss := claims.String("iss"); iss != p.issuer {
+		return fmt.Errorf("ID token has issuer %q, expected %q", iss, p.issuer)
+	}
+
+	aud := claims.Strings("aud")
+	if !slices.Contains(aud, p.clientId) {
+		return errors.New("ID token was not issued for this client")
+	}
+
+	if azp := claims.String("azp"); azp != "" && azp != p.clientId {
+		return errors.New("ID token was issued to another party")
+	}
+
+	now := time.Now()
+	exp, ok := claims.time("exp")
+	if !ok || !now.Before(exp.Add(clockSkew)) {
+		return errors.New("ID token has expired")
+	}
+
+	if iat, ok := claims.time("iat"); ok && now.Add(clockSkew).Before(iat) {
+		return errors.New("ID token was issued in the future")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(claims.String("nonce")), []byte(nonce)) != 1 {
+		return errors.New("ID token has an invalid nonce")
+	}
+
+	if claims.String("sub") == "" {
+		return errors.New("ID token has no subject")
+	}
+
+	return nil
+}
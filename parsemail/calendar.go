@@ -0,0 +1,361 @@
+package parsemail
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	// TZID parameters are resolved with the IANA database, which may not be
+	// installed on the host
+	_ "time/tzdata"
+)
+
+const (
+	contentTypeTextCalendar = "text/calendar"
+	contentTypeICS          = "application/ics"
+)
+
+var ErrInvalidCalendar = errors.New("invalid iCalendar data")
+
+// CalendarAddress is an ORGANIZER or ATTENDEE of an event.
+type CalendarAddress struct {
+	Email    string
+	Name     string
+	Role     string
+	PartStat string
+	RSVP     bool
+}
+
+// CalendarEvent is a VEVENT component of an iCalendar object, as described in
+// RFC 5545. Method is taken from the enclosing VCALENDAR. Start and End are
+// zero if the event doesn't have them; End is derived from DURATION if there
+// is no DTEND.
+type CalendarEvent struct {
+	Method       string
+	UID          string
+	Sequence     int
+	RecurrenceID string
+	Summary      string
+	Description  string
+	Location     string
+	Status       string
+	Organizer    *CalendarAddress
+	Attendees    []CalendarAddress
+	Start        time.Time
+	End          time.Time
+	AllDay       bool
+	TimeZone     string
+	RRule        string
+}
+
+func isCalendar(contentType string) bool {
+	return contentType == contentTypeTextCalendar || contentType == contentTypeICS
+}
+
+type contentLine struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+// ParseCalendar parses the events in an iCalendar object.
+func ParseCalendar(data []byte) ([]CalendarEvent, error) {
+	lines := unfoldLines(string(data))
+
+	var events []CalendarEvent
+	var event *CalendarEvent
+	var method string
+	var duration time.Duration
+	var hasDuration bool
+	var stack []string
+	seenCalendar := false
+
+	for _, raw := range lines {
+		line, ok := parseContentLine(raw)
+		if !ok {
+			continue
+		}
+
+		switch line.name {
+		case "BEGIN":
+			comp := strings.ToUpper(line.value)
+			stack = append(stack, comp)
+			seenCalendar = seenCalendar || comp == "VCALENDAR"
+			if comp == "VEVENT" && len(stack) == 2 && stack[0] == "VCALENDAR" {
+				event = &CalendarEvent{Method: method}
+				duration, hasDuration = 0, false
+			}
+			continue
+		case "END":
+			if len(stack) == 0 {
+				return nil, ErrInvalidCalendar
+			}
+
+			stack = stack[:len(stack)-1]
+			if event != nil && len(stack) == 1 {
+				if event.End.IsZero() && hasDuration && !event.Start.IsZero() {
+					event.End = event.Start.Add(duration)
+				}
+
+				events = append(events, *event)
+				event = nil
+			}
+			continue
+		}
+
+		if len(stack) == 1 && line.name == "METHOD" {
+			method = strings.ToUpper(line.value)
+			for i := range events {
+				events[i].Method = method
+			}
+			continue
+		}
+
+		// properties of nested components such as VALARM are ignored
+		if event == nil || len(stack) != 2 {
+			continue
+		}
+
+		switch line.name {
+		case "UID":
+			event.UID = line.value
+		case "SEQUENCE":
+			event.Sequence, _ = strconv.Atoi(line.value)
+		case "RECURRENCE-ID":
+			event.RecurrenceID = line.value
+		case "SUMMARY":
+			event.Summary = unescapeText(line.value)
+		case "DESCRIPTION":
+			event.Description = unescapeText(line.value)
+		case "LOCATION":
+			event.Location = unescapeText(line.value)
+		case "STATUS":
+			event.Status = strings.ToUpper(line.value)
+		case "RRULE":
+			event.RRule = line.value
+		case "ORGANIZER":
+			addr := parseCalendarAddress(line)
+			event.Organizer = &addr
+		case "ATTENDEE":
+			event.Attendees = append(event.Attendees, parseCalendarAddress(line))
+		case "DTSTART":
+			event.Start, event.AllDay = parseCalendarTime(line)
+			event.TimeZone = line.params["TZID"]
+		case "DTEND":
+			event.End, _ = parseCalendarTime(line)
+		case "DURATION":
+			duration, hasDuration = parseDuration(line.value)
+		}
+	}
+
+	if !seenCalendar || len(stack) != 0 {
+		return events, ErrInvalidCalendar
+	}
+
+	return events, nil
+}
+
+// unfoldLines splits the data into content lines, joining lines that were
+// folded by starting them with a space or a tab.
+func unfoldLines(data string) []string {
+	var lines []string
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines
+}
+
+// parseContentLine parses a line of the form NAME;PARAM=VALUE:VALUE. Colons
+// and semicolons within quoted parameter values are not treated as separators.
+func parseContentLine(line string) (contentLine, bool) {
+	result := contentLine{params: map[string]string{}}
+
+	inQuote := false
+	nameEnd, valueStart := -1, -1
+	for i := 0; i < len(line) && valueStart < 0; i++ {
+		switch line[i] {
+		case '"':
+			inQuote = !inQuote
+		case ';':
+			if !inQuote && nameEnd < 0 {
+				nameEnd = i
+			}
+		case ':':
+			if !inQuote {
+				valueStart = i + 1
+			}
+		}
+	}
+
+	if valueStart < 0 {
+		return result, false
+	}
+
+	if nameEnd < 0 {
+		nameEnd = valueStart - 1
+	}
+
+	result.name = strings.ToUpper(strings.TrimSpace(line[:nameEnd]))
+	result.value = line[valueStart:]
+
+	for _, param := range splitQuoted(line[nameEnd:valueStart-1], ';') {
+		name, value, ok := strings.Cut(param, "=")
+		if !ok {
+			continue
+		}
+
+		result.params[strings.ToUpper(strings.TrimSpace(name))] = strings.Trim(value, "\"")
+	}
+
+	return result, result.name != ""
+}
+
+func splitQuoted(s string, sep byte) []string {
+	var result []string
+	inQuote := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			inQuote = !inQuote
+		case sep:
+			if !inQuote {
+				result = append(result, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	return append(result, s[start:])
+}
+
+func unescapeText(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		i++
+		switch s[i] {
+		case 'n', 'N':
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+
+	return b.String()
+}
+
+func parseCalendarAddress(line contentLine) CalendarAddress {
+	addr := CalendarAddress{
+		Email:    line.value,
+		Name:     line.params["CN"],
+		Role:     strings.ToUpper(line.params["ROLE"]),
+		PartStat: strings.ToUpper(line.params["PARTSTAT"]),
+		RSVP:     strings.EqualFold(line.params["RSVP"], "TRUE"),
+	}
+
+	if len(addr.Email) > 7 && strings.EqualFold(addr.Email[:7], "mailto:") {
+		addr.Email = addr.Email[7:]
+	}
+
+	return addr
+}
+
+// parseCalendarTime parses a DATE or DATE-TIME value, and reports whether it
+// is a DATE. Times with a TZID that is not a known IANA time zone, and floating
+// times, are interpreted as UTC.
+func parseCalendarTime(line contentLine) (time.Time, bool) {
+	value := strings.TrimSpace(line.value)
+	if strings.EqualFold(line.params["VALUE"], "DATE") || len(value) == 8 {
+		t, err := time.Parse("20060102", value)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return t, true
+	}
+
+	if strings.HasSuffix(value, "Z") {
+		t, _ := time.Parse("20060102T150405Z", value)
+		return t, false
+	}
+
+	loc := time.UTC
+	if tzid := line.params["TZID"]; tzid != "" {
+		if l, err := time.LoadLocation(tzid); err == nil {
+			loc = l
+		}
+	}
+
+	t, _ := time.ParseInLocation("20060102T150405", value, loc)
+	return t, false
+}
+
+// parseDuration parses a duration such as P1W, P1DT2H or -PT15M.
+func parseDuration(s string) (time.Duration, bool) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	sign := time.Duration(1)
+	if rest, ok := strings.CutPrefix(s, "-"); ok {
+		sign, s = -1, rest
+	} else {
+		s = strings.TrimPrefix(s, "+")
+	}
+
+	s, ok := strings.CutPrefix(s, "P")
+	if !ok || s == "" {
+		return 0, false
+	}
+
+	var d time.Duration
+	inTime := false
+	num := 0
+	hasNum := false
+	for _, c := range s {
+		switch {
+		case c >= '0' && c <= '9':
+			num = num*10 + int(c-'0')
+			hasNum = true
+			continue
+		case c == 'T':
+			inTime = true
+			continue
+		}
+
+		if !hasNum {
+			return 0, false
+		}
+
+		n := time.Duration(num)
+		switch {
+		case c == 'W' && !inTime:
+			d += n * 7 * 24 * time.Hour
+		case c == 'D' && !inTime:
+			d += n * 24 * time.Hour
+		case c == 'H' && inTime:
+			d += n * time.Hour
+		case c == 'M' && inTime:
+			d += n * time.Minute
+		case c == 'S' && inTime:
+			d += n * time.Second
+		default:
+			return 0, false
+		}
+
+		num, hasNum = 0, false
+	}
+
+	return sign * d, !hasNum
+}
@@ -0,0 +1,85 @@
+package parsemail
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"regexp"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/ianaindex"
+)
+
+var metaCharsetRe = regexp.MustCompile(`(?i)<meta[^>]+charset\s*=\s*["']?\s*([\w.:-]+)`)
+
+var wordDecoder = &mime.WordDecoder{CharsetReader: charsetReader}
+
+func isUTF8(charset string) bool {
+	switch strings.ToLower(charset) {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return true
+	}
+
+	return false
+}
+
+// lookupCharset finds an encoding by its label, using the WHATWG labels
+// first since they cover the aliases commonly seen in mail, and then the IANA
+// registry.
+func lookupCharset(charset string) (encoding.Encoding, error) {
+	if enc, err := htmlindex.Get(charset); err == nil {
+		return enc, nil
+	}
+
+	enc, err := ianaindex.MIME.Encoding(charset)
+	if err != nil || enc == nil {
+		return nil, fmt.Errorf("unsupported charset: %s", charset)
+	}
+
+	return enc, nil
+}
+
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	if isUTF8(charset) {
+		return input, nil
+	}
+
+	enc, err := lookupCharset(charset)
+	if err != nil {
+		return nil, err
+	}
+
+	return enc.NewDecoder().Reader(input), nil
+}
+
+// decodeCharset converts data in the given charset to UTF-8.
+func decodeCharset(data []byte, charset string) ([]byte, error) {
+	if isUTF8(charset) {
+		return data, nil
+	}
+
+	enc, err := lookupCharset(charset)
+	if err != nil {
+		return nil, err
+	}
+
+	return enc.NewDecoder().Bytes(data)
+}
+
+// htmlCharset returns the charset declared by a meta tag near the start of
+// an HTML document, for HTML parts that don't declare a charset in their
+// Content-Type.
+func htmlCharset(data []byte) string {
+	if len(data) > 1024 {
+		data = data[:1024]
+	}
+
+	if m := metaCharsetRe.FindSubmatch(data); m != nil {
+		return string(bytes.ToLower(m[1]))
+	}
+
+	return ""
+}
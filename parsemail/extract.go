@@ -0,0 +1,221 @@
+package parsemail
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Link is a URL found in the body of a message. Text is the anchor text of
+// links in an HTML body, and is empty for URLs that appear in plain text.
+type Link struct {
+	URL  string
+	Text string
+}
+
+// Code is a likely one-time code, along with the line it was found on.
+// Pattern is the pattern that matched it, or nil if it was found by the
+// built-in detection.
+type Code struct {
+	Code    string
+	Context string
+	Pattern *regexp.Regexp
+}
+
+var urlRe = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"'` + "`" + `]+`)
+
+// codeKeywordRe matches the words that usually introduce a one-time code
+var codeKeywordRe = regexp.MustCompile(`(?i)\b(?:code|otp|passcode|password|pin|verif\w*|one[- ]time|token|2fa|two[- ](?:factor|step)|sign[- ]?in|log[- ]?in|confirm\w*|security)\b`)
+
+var codeCandidateRe = regexp.MustCompile(`\b(?:\d{3}[- ]\d{3}|[A-Z0-9]{4,10}(?:-[A-Z0-9]{3,10})?|\d{4,10})\b`)
+
+// maxCodeDistance is how many lines after a line with a keyword a code is
+// looked for, since codes are often shown on a line of their own
+const maxCodeDistance = 2
+
+// ExtractHTMLLinks returns the links in an HTML document, and the URLs that
+// appear in its text outside of links, in the order in which they appear.
+func ExtractHTMLLinks(data string) []Link {
+	doc, err := html.Parse(strings.NewReader(data))
+	if err != nil {
+		return nil
+	}
+
+	var links []Link
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		switch {
+		case n.Type == html.TextNode:
+			links = append(links, ExtractTextLinks(n.Data)...)
+			return
+		case n.Type == html.ElementNode && (n.DataAtom == atom.Script || n.DataAtom == atom.Style):
+			return
+		case n.Type == html.ElementNode && n.DataAtom == atom.A:
+			href := strings.TrimSpace(attr(n, "href"))
+			if href != "" && href != "#" && !strings.HasPrefix(strings.ToLower(href), "javascript:") {
+				t := newTextWriter()
+				renderChildren(t, n, false)
+				text := strings.Join(strings.Fields(t.String()), " ")
+				links = append(links, Link{URL: href, Text: text})
+				return
+			}
+		}
+
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+
+	walk(doc)
+	return links
+}
+
+// ExtractTextLinks returns the http, https and www. URLs in plain text.
+func ExtractTextLinks(text string) []Link {
+	var links []Link
+	for _, u := range urlRe.FindAllString(text, -1) {
+		if u = trimURL(u); u != "" {
+			links = append(links, Link{URL: u})
+		}
+	}
+
+	return links
+}
+
+// trimURL removes punctuation that ends the sentence containing a URL, and
+// closing brackets that don't have a matching opening bracket in the URL.
+func trimURL(u string) string {
+	for u != "" {
+		last := u[len(u)-1]
+		switch {
+		case strings.IndexByte(".,;:!?'\"*", last) >= 0:
+			u = u[:len(u)-1]
+		case last == ')' && strings.Count(u, "(") < strings.Count(u, ")"):
+			u = u[:len(u)-1]
+		case last == ']' && strings.Count(u, "[") < strings.Count(u, "]"):
+			u = u[:len(u)-1]
+		default:
+			return u
+		}
+	}
+
+	return u
+}
+
+// FindCodes returns the codes in a text, without duplicates. If patterns are
+// given, the codes are the matches of the first capturing group of each
+// pattern, or the whole match if the pattern has no groups. Otherwise, codes
+// are numbers and uppercase alphanumeric tokens on the same line as words
+// such as "code", "OTP" or "verification", or on a line of their own shortly
+// after them.
+func FindCodes(text string, patterns []*regexp.Regexp) []Code {
+	var codes []Code
+	seen := map[string]bool{}
+	add := func(code, context string, re *regexp.Regexp) {
+		if code != "" && !seen[code] {
+			seen[code] = true
+			codes = append(codes, Code{Code: code, Context: context, Pattern: re})
+		}
+	}
+
+	if len(patterns) > 0 {
+		for _, re := range patterns {
+			for _, m := range re.FindAllStringSubmatchIndex(text, -1) {
+				start, end := m[0], m[1]
+				if len(m) >= 4 && m[2] >= 0 {
+					start, end = m[2], m[3]
+				}
+
+				add(text[start:end], lineAt(text, start), re)
+			}
+		}
+
+		return codes
+	}
+
+	distance := maxCodeDistance + 1
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if codeKeywordRe.MatchString(line) {
+			distance = 0
+		} else {
+			distance++
+		}
+
+		if distance > maxCodeDistance {
+			continue
+		}
+
+		// codes on the following lines must be on a line of their own
+		candidates := codeCandidates(line)
+		if distance > 0 && (len(candidates) != 1 || strings.Trim(line, " .:*") != candidates[0]) {
+			continue
+		}
+
+		for _, code := range candidates {
+			add(code, line, nil)
+		}
+	}
+
+	return codes
+}
+
+// codeCandidates returns the tokens in a line that look like codes. Tokens
+// must contain a digit, and must not be part of a URL, email address, date,
+// time or amount.
+func codeCandidates(line string) []string {
+	var result []string
+	for _, m := range codeCandidateRe.FindAllStringIndex(line, -1) {
+		token := line[m[0]:m[1]]
+		if !strings.ContainsFunc(token, unicode.IsDigit) {
+			continue
+		}
+
+		start, end := m[0], m[1]
+		for start > 0 && isWordChar(line[start-1]) {
+			start--
+		}
+		for end < len(line) && isWordChar(line[end]) {
+			end++
+		}
+
+		word := strings.TrimRight(line[start:end], ".,:;")
+		if word != token {
+			continue
+		}
+
+		before := strings.TrimRight(line[:start], " ")
+		if r, _ := utf8.DecodeLastRuneInString(before); strings.ContainsRune("$€£¥#©", r) {
+			continue
+		}
+
+		result = append(result, token)
+	}
+
+	return result
+}
+
+func isWordChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		strings.IndexByte("-_./:@,%", c) >= 0
+}
+
+func lineAt(text string, i int) string {
+	start := strings.LastIndexByte(text[:i], '\n') + 1
+	end := strings.IndexByte(text[i:], '\n')
+	if end < 0 {
+		end = len(text)
+	} else {
+		end += i
+	}
+
+	return strings.TrimSpace(text[start:end])
+}
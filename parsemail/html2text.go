@@ -0,0 +1,442 @@
+package parsemail
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// textWriter accumulates the plain text rendering of an HTML document. Text is
+// written a line at a time, and every line starts with the prefixes of the
+// enclosing block quotes and list items.
+type textWriter struct {
+	b        strings.Builder
+	prefixes []string
+	marker   string
+	newlines int
+	depth    int
+	space    bool
+	empty    bool
+}
+
+func newTextWriter() *textWriter {
+	return &textWriter{empty: true}
+}
+
+// breakLines makes sure that the next text starts after at least n line breaks.
+// Blank lines are prefixed with the quotes that enclose both the text before
+// and after them.
+func (t *textWriter) breakLines(n int) {
+	if t.newlines == 0 {
+		t.depth = len(t.prefixes)
+	} else {
+		t.depth = min(t.depth, len(t.prefixes))
+	}
+
+	if !t.empty && t.newlines < n {
+		t.newlines = n
+	}
+	t.space = false
+}
+
+func (t *textWriter) startLine() {
+	blank := strings.Join(t.prefixes[:min(t.depth, len(t.prefixes))], "")
+	for i := 0; i < t.newlines; i++ {
+		t.b.WriteByte('\n')
+		if i < t.newlines-1 {
+			t.b.WriteString(strings.TrimRight(blank, " "))
+		}
+	}
+
+	if t.marker != "" && len(t.prefixes) > 0 {
+		t.b.WriteString(strings.Join(t.prefixes[:len(t.prefixes)-1], ""))
+		t.b.WriteString(t.marker)
+		t.marker = ""
+	} else {
+		t.b.WriteString(strings.Join(t.prefixes, ""))
+	}
+
+	t.newlines = 0
+	t.empty = false
+}
+
+// write writes text with its whitespace collapsed.
+func (t *textWriter) write(s string) {
+	if s == "" {
+		return
+	}
+
+	if r, _ := utf8.DecodeRuneInString(s); unicode.IsSpace(r) {
+		t.space = true
+	}
+
+	for i, word := range strings.Fields(s) {
+		if t.empty || t.newlines > 0 {
+			t.startLine()
+		} else if t.space || i > 0 {
+			t.b.WriteByte(' ')
+		}
+
+		t.b.WriteString(word)
+		t.space = false
+	}
+
+	if r, _ := utf8.DecodeLastRuneInString(s); unicode.IsSpace(r) {
+		t.space = true
+	}
+}
+
+// writePre writes preformatted text, keeping its whitespace and line breaks.
+func (t *textWriter) writePre(s string) {
+	for i, line := range strings.Split(s, "\n") {
+		if i > 0 {
+			t.breakLines(t.newlines + 1)
+		}
+
+		if line != "" {
+			if t.empty || t.newlines > 0 {
+				t.startLine()
+			}
+			t.b.WriteString(strings.TrimRight(line, "\r"))
+		}
+	}
+}
+
+// writeLine writes a line of text as is, on a line of its own.
+func (t *textWriter) writeLine(s string) {
+	t.breakLines(1)
+	t.startLine()
+	t.b.WriteString(s)
+	t.newlines = 1
+}
+
+func (t *textWriter) String() string {
+	lines := strings.Split(t.b.String(), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// HTMLToText renders an HTML document as plain text. Paragraphs and other
+// blocks are separated by blank lines, links are followed by their URL, list
+// items are marked with bullets or numbers, and tables of data are laid out in
+// aligned columns.
+func HTMLToText(data string) string {
+	doc, err := html.Parse(strings.NewReader(data))
+	if err != nil {
+		return ""
+	}
+
+	t := newTextWriter()
+	renderNode(t, doc, false)
+
+	if s := t.String(); s != "" {
+		return s + "\n"
+	}
+
+	return ""
+}
+
+func renderChildren(t *textWriter, n *html.Node, pre bool) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		renderNode(t, c, pre)
+	}
+}
+
+func renderNode(t *textWriter, n *html.Node, pre bool) {
+	switch n.Type {
+	case html.TextNode:
+		if pre {
+			t.writePre(n.Data)
+		} else {
+			t.write(n.Data)
+		}
+		return
+	case html.DocumentNode:
+		renderChildren(t, n, pre)
+		return
+	case html.ElementNode:
+	default:
+		return
+	}
+
+	if isHidden(n) {
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Head, atom.Script, atom.Style, atom.Template, atom.Title, atom.Noscript:
+		return
+	case atom.Br:
+		t.breakLines(min(t.newlines+1, 2))
+	case atom.Hr:
+		t.breakLines(2)
+		t.writeLine(strings.Repeat("-", 40))
+		t.breakLines(2)
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		level := int(n.Data[1] - '0')
+		t.breakLines(2)
+		t.write(strings.Repeat("#", level) + " ")
+		renderChildren(t, n, pre)
+		t.breakLines(2)
+	case atom.P, atom.Blockquote, atom.Pre, atom.Ul, atom.Ol, atom.Dl, atom.Figure:
+		// lists nested in a list item are not separated by blank lines
+		gap := 2
+		if n.Parent != nil && n.Parent.DataAtom == atom.Li {
+			gap = 1
+		}
+
+		t.breakLines(gap)
+		switch n.DataAtom {
+		case atom.Blockquote:
+			t.prefixes = append(t.prefixes, "> ")
+			renderChildren(t, n, pre)
+			t.prefixes = t.prefixes[:len(t.prefixes)-1]
+		case atom.Pre:
+			renderChildren(t, n, true)
+		case atom.Ul, atom.Ol:
+			renderList(t, n, pre)
+		default:
+			renderChildren(t, n, pre)
+		}
+		t.breakLines(gap)
+	case atom.Li:
+		// list items outside of a list
+		renderListItem(t, n, "* ", pre)
+	case atom.Table:
+		t.breakLines(2)
+		if rows := tableRows(n); isDataTable(n, rows) {
+			renderTable(t, rows)
+		} else {
+			renderChildren(t, n, pre)
+		}
+		t.breakLines(2)
+	case atom.A:
+		renderLink(t, n, pre)
+	case atom.Img:
+		if alt := strings.TrimSpace(attr(n, "alt")); alt != "" {
+			t.write(alt)
+		}
+	default:
+		if isBlock(n.DataAtom) {
+			t.breakLines(1)
+			renderChildren(t, n, pre)
+			t.breakLines(1)
+		} else {
+			renderChildren(t, n, pre)
+		}
+	}
+}
+
+func isBlock(a atom.Atom) bool {
+	switch a {
+	case atom.Div, atom.Section, atom.Article, atom.Header, atom.Footer,
+		atom.Nav, atom.Aside, atom.Main, atom.Address, atom.Center,
+		atom.Tr, atom.Td, atom.Th, atom.Caption, atom.Dt, atom.Dd,
+		atom.Figcaption, atom.Form, atom.Fieldset, atom.Details, atom.Summary:
+		return true
+	}
+
+	return false
+}
+
+// isHidden reports whether an element is hidden with an inline style, which
+// is commonly done for the preview text of a message.
+func isHidden(n *html.Node) bool {
+	style := strings.ToLower(strings.ReplaceAll(attr(n, "style"), " ", ""))
+	return strings.Contains(style, "display:none")
+}
+
+func attr(n *html.Node, name string) string {
+	for _, a := range n.Attr {
+		if a.Key == name {
+			return a.Val
+		}
+	}
+
+	return ""
+}
+
+func renderList(t *textWriter, n *html.Node, pre bool) {
+	num := 1
+	if start, err := strconv.Atoi(attr(n, "start")); err == nil {
+		num = start
+	}
+
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode || c.DataAtom != atom.Li {
+			renderNode(t, c, pre)
+			continue
+		}
+
+		marker := "* "
+		if n.DataAtom == atom.Ol {
+			marker = strconv.Itoa(num) + ". "
+			num++
+		}
+
+		renderListItem(t, c, marker, pre)
+	}
+}
+
+func renderListItem(t *textWriter, n *html.Node, marker string, pre bool) {
+	t.breakLines(1)
+	t.prefixes = append(t.prefixes, strings.Repeat(" ", len(marker)))
+	t.marker = marker
+	renderChildren(t, n, pre)
+	t.marker = ""
+	t.prefixes = t.prefixes[:len(t.prefixes)-1]
+	t.breakLines(1)
+}
+
+// renderLink writes the text of a link followed by its URL, unless the text
+// is the URL itself.
+func renderLink(t *textWriter, n *html.Node, pre bool) {
+	href := strings.TrimSpace(attr(n, "href"))
+	lower := strings.ToLower(href)
+	if href == "" || strings.HasPrefix(href, "#") || strings.HasPrefix(lower, "javascript:") {
+		renderChildren(t, n, pre)
+		return
+	}
+
+	inner := newTextWriter()
+	renderChildren(inner, n, pre)
+	text := inner.String()
+
+	target := href
+	if strings.HasPrefix(lower, "mailto:") {
+		target = href[len("mailto:"):]
+	}
+
+	switch {
+	case text == "":
+		t.write(target)
+	case text == target || text == href:
+		t.write(text)
+	default:
+		renderChildren(t, n, pre)
+		t.write(" (" + href + ")")
+	}
+}
+
+// tableRows returns the rows of a table, not including the rows of nested
+// tables.
+func tableRows(table *html.Node) []*html.Node {
+	var rows []*html.Node
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode {
+				continue
+			}
+
+			switch c.DataAtom {
+			case atom.Tr:
+				rows = append(rows, c)
+			case atom.Thead, atom.Tbody, atom.Tfoot:
+				walk(c)
+			}
+		}
+	}
+
+	walk(table)
+	return rows
+}
+
+func rowCells(row *html.Node) []*html.Node {
+	var cells []*html.Node
+	for c := row.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && (c.DataAtom == atom.Td || c.DataAtom == atom.Th) {
+			cells = append(cells, c)
+		}
+	}
+
+	return cells
+}
+
+// isDataTable reports whether a table holds data to be laid out in columns,
+// rather than being used for the layout of the message, which is common in
+// HTML email. Layout tables usually contain other tables or have a single
+// column.
+func isDataTable(table *html.Node, rows []*html.Node) bool {
+	if len(rows) == 0 || hasDescendant(table, atom.Table) {
+		return false
+	}
+
+	for _, row := range rows {
+		if len(rowCells(row)) > 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasDescendant(n *html.Node, a atom.Atom) bool {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if (c.Type == html.ElementNode && c.DataAtom == a) || hasDescendant(c, a) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func renderTable(t *textWriter, rows []*html.Node) {
+	var cells [][]string
+	var widths []int
+	header := -1
+
+	for i, row := range rows {
+		var line []string
+		allTh := true
+		for j, cell := range rowCells(row) {
+			inner := newTextWriter()
+			renderChildren(inner, cell, false)
+			text := strings.Join(strings.Fields(inner.String()), " ")
+			line = append(line, text)
+
+			if j == len(widths) {
+				widths = append(widths, 0)
+			}
+			widths[j] = max(widths[j], utf8.RuneCountInString(text))
+			allTh = allTh && cell.DataAtom == atom.Th
+		}
+
+		if allTh && len(line) > 0 && i == 0 {
+			header = i
+		}
+		cells = append(cells, line)
+	}
+
+	for i, line := range cells {
+		var b strings.Builder
+		for j, text := range line {
+			if j > 0 {
+				b.WriteString(" | ")
+			}
+			b.WriteString(text)
+			if j < len(line)-1 {
+				b.WriteString(strings.Repeat(" ", widths[j]-utf8.RuneCountInString(text)))
+			}
+		}
+
+		if strings.TrimSpace(b.String()) != "" {
+			t.writeLine(b.String())
+		}
+
+		if i == header {
+			sep := make([]string, len(widths))
+			for j, w := range widths {
+				sep[j] = strings.Repeat("-", max(w, 1))
+			}
+			t.writeLine(strings.Join(sep, "-|-"))
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package parsemail
+
+import (
+	"net/textproto"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const maxFilenameLength = 255
+
+// parseParams parses the parameters of a Content-Type or Content-Disposition
+// value, including RFC 2231 extended values and continuations in any charset.
+// Unlike mime.ParseMediaType, it does not reject the whole value when some of
+// the parameters are malformed or repeated.
+func parseParams(value string) map[string]string {
+	_, rest, _ := strings.Cut(value, ";")
+
+	raw := map[string]string{}
+	for rest != "" {
+		rest = strings.TrimLeft(rest, " \t\r\n;")
+		name, after, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+
+		name = strings.ToLower(strings.TrimSpace(name))
+		if strings.ContainsAny(name, ";\"") {
+			// a parameter without a value, skip past it
+			_, rest, _ = strings.Cut(rest, ";")
+			continue
+		}
+
+		var v string
+		v, rest = readParamValue(strings.TrimLeft(after, " \t\r\n"))
+		if _, ok := raw[name]; !ok && name != "" {
+			raw[name] = v
+		}
+	}
+
+	params := map[string]string{}
+	extended := map[string]bool{}
+	sections := map[string][]string{}
+
+	for name, v := range raw {
+		base, section, isSection := strings.Cut(name, "*")
+		switch {
+		case !isSection:
+			if !extended[base] {
+				params[base] = v
+			}
+		case section == "":
+			if decoded, ok := decodeExtValue(v); ok {
+				params[base] = decoded
+				extended[base] = true
+			}
+		default:
+			sections[base] = append(sections[base], section)
+		}
+	}
+
+	for base, names := range sections {
+		if extended[base] {
+			continue
+		}
+
+		if v, ok := joinSections(base, names, raw); ok {
+			params[base] = v
+			extended[base] = true
+		}
+	}
+
+	return params
+}
+
+// readParamValue reads a token or quoted string from the start of s, and
+// returns it along with the rest of s.
+func readParamValue(s string) (string, string) {
+	if !strings.HasPrefix(s, "\"") {
+		v, rest, _ := strings.Cut(s, ";")
+		return strings.TrimSpace(v), rest
+	}
+
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"':
+			_, rest, _ := strings.Cut(s[i+1:], ";")
+			return b.String(), rest
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				b.WriteByte(s[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String(), ""
+}
+
+// decodeExtValue decodes an RFC 2231 extended value of the form
+// charset'language'percent-encoded-value.
+func decodeExtValue(v string) (string, bool) {
+	parts := strings.SplitN(v, "'", 3)
+	if len(parts) != 3 {
+		return "", false
+	}
+
+	return convertParam([]byte(percentDecode(parts[2])), parts[0])
+}
+
+// joinSections joins the sections of an RFC 2231 continuation in order. The
+// charset is declared by the first section if it is encoded, and applies to
+// all the encoded sections.
+func joinSections(base string, names []string, raw map[string]string) (string, bool) {
+	type section struct {
+		n       int
+		encoded bool
+		value   string
+	}
+
+	var list []section
+	for _, name := range names {
+		num, encoded := strings.CutSuffix(name, "*")
+		n, err := strconv.Atoi(num)
+		if err != nil || (num != "0" && strings.HasPrefix(num, "0")) {
+			continue
+		}
+
+		list = append(list, section{n, encoded, raw[base+"*"+name]})
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].n < list[j].n })
+	if len(list) == 0 || list[0].n != 0 {
+		return "", false
+	}
+
+	charset := ""
+	var buf []byte
+	for i, s := range list {
+		if s.n != i {
+			break
+		}
+
+		if !s.encoded {
+			buf = append(buf, s.value...)
+			continue
+		}
+
+		v := s.value
+		if i == 0 {
+			parts := strings.SplitN(v, "'", 3)
+			if len(parts) != 3 {
+				return "", false
+			}
+			charset, v = parts[0], parts[2]
+		}
+
+		buf = append(buf, percentDecode(v)...)
+	}
+
+	return convertParam(buf, charset)
+}
+
+func convertParam(data []byte, charset string) (string, bool) {
+	decoded, err := decodeCharset(data, charset)
+	if err != nil {
+		return "", false
+	}
+
+	return string(decoded), true
+}
+
+func percentDecode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 2
+				continue
+			}
+		}
+
+		b.WriteByte(s[i])
+	}
+
+	return b.String()
+}
+
+// partFilename returns the decoded and sanitized filename of a part, taken
+// from the filename parameter of the Content-Disposition, or from the name
+// parameter of the Content-Type.
+func partFilename(header textproto.MIMEHeader, charset string) string {
+	name := parseParams(header.Get("Content-Disposition"))["filename"]
+	if name == "" {
+		name = parseParams(header.Get("Content-Type"))["name"]
+	}
+
+	if strings.Contains(name, "=?") {
+		name = decodeMimeSentence(name)
+	}
+
+	// some clients send raw 8-bit filenames, which are usually in the charset
+	// of the part
+	if !utf8.ValidString(name) {
+		if decoded, err := decodeCharset([]byte(name), charset); err == nil && utf8.Valid(decoded) {
+			name = string(decoded)
+		} else {
+			name = strings.ToValidUTF8(name, "_")
+		}
+	}
+
+	return sanitizeFilename(name)
+}
+
+// sanitizeFilename makes a filename safe to save to disk: directory
+// components, control characters and characters that are reserved on common
+// filesystems are removed, and the length is limited to 255 bytes while
+// keeping the extension.
+func sanitizeFilename(name string) string {
+	if i := strings.LastIndexAny(name, "/\\"); i >= 0 {
+		name = name[i+1:]
+	}
+
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsControl(r), r == utf8.RuneError:
+			return -1
+		case strings.ContainsRune(`<>:"|?*`, r):
+			return '_'
+		}
+		return r
+	}, name)
+
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+	name = strings.TrimRight(name, ". ")
+
+	if len(name) > maxFilenameLength {
+		ext := path.Ext(name)
+		if len(ext) > 16 {
+			ext = ""
+		}
+
+		stem := name[:len(name)-len(ext)]
+		stem = truncateUTF8(stem, maxFilenameLength-len(ext))
+		name = stem + ext
+	}
+
+	return name
+}
+
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+
+	return s[:n]
+}
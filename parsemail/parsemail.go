@@ -5,83 +5,250 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io"
-	"mime"
-	"mime/multipart"
 	"mime/quotedprintable"
 	"net/mail"
 	"strings"
 	"time"
 )
 
-const contentTypeMultipartMixed = "multipart/mixed"
 const contentTypeMultipartAlternative = "multipart/alternative"
 const contentTypeMultipartRelated = "multipart/related"
 const contentTypeTextHtml = "text/html"
 const contentTypeTextPlain = "text/plain"
-const contentTypeOctetStream = "application/octet-stream"
+
+var addressParser = &mail.AddressParser{WordDecoder: wordDecoder}
+
+// maxEmbeddingDepth limits how deeply message/rfc822 parts are parsed
+const maxEmbeddingDepth = 8
 
 // Parse an email message read from io.Reader into parsemail.Email struct
 func Parse(r io.Reader) (email Email, err error) {
-	msg, err := mail.ReadMessage(r)
+	return ParseWithKeys(r, nil)
+}
+
+// ParseWithKeys parses an email message like Parse, and also verifies the
+// signatures and decrypts the S/MIME and PGP/MIME parts of the message with
+// the given keys. The decrypted parts are used in place of the encrypted ones.
+func ParseWithKeys(r io.Reader, keys *Keyring) (email Email, err error) {
+	data, err := io.ReadAll(r)
 	if err != nil {
 		return
 	}
 
-	email, err = createEmailFromHeader(msg.Header)
+	return parse(data, 0, keys)
+}
+
+func parse(data []byte, depth int, keys *Keyring) (email Email, err error) {
+	root, err := ParseTree(data)
 	if err != nil {
 		return
 	}
 
-	email.ContentType = msg.Header.Get("Content-Type")
-	contentType, params, err := parseContentType(email.ContentType)
-	if err != nil {
-		return
+	email, err = createEmailFromHeader(mail.Header(root.Header))
+	email.ContentType = root.Header.Get("Content-Type")
+	email.Root = root
+
+	w := walker{data: data, email: &email, depth: depth, keys: keys}
+	w.walk(root, false)
+	w.applyTNEF()
+	if err == nil {
+		err = w.err
 	}
 
-	cte := msg.Header.Get("Content-Transfer-Encoding")
+	return
+}
 
-	switch contentType {
-	case contentTypeMultipartMixed:
-		email.TextBody, email.HTMLBody, email.Attachments, email.EmbeddedFiles, err = parseMultipartMixed(msg.Body, params["boundary"])
-	case contentTypeMultipartAlternative:
-		email.TextBody, email.HTMLBody, email.EmbeddedFiles, err = parseMultipartAlternative(msg.Body, params["boundary"])
-	case contentTypeMultipartRelated:
-		email.TextBody, email.HTMLBody, email.EmbeddedFiles, err = parseMultipartRelated(msg.Body, params["boundary"])
-	case contentTypeTextPlain:
-		message, _ := io.ReadAll(msg.Body)
-		var reader io.Reader
-		reader, err = decodeContent(strings.NewReader(string(message[:])), cte)
-		if err != nil {
-			return
-		}
+// walker flattens a MIME tree into the bodies and attachments of an Email.
+// Decoding errors are recorded, but do not stop the remaining parts from
+// being processed.
+type walker struct {
+	data   []byte
+	email  *Email
+	depth  int
+	err    error
+	tnef   []*TNEF
+	keys   *Keyring
+	layers int
+}
 
-		message, err = io.ReadAll(reader)
-		if err != nil {
+func (w *walker) setErr(p *Part, err error) {
+	if w.err == nil {
+		w.err = fmt.Errorf("part %s: %w", p.Path, err)
+	}
+}
+
+func (w *walker) walk(p *Part, inRelated bool) {
+	if p.IsMultipart() && len(p.Parts) == 2 && w.layers < maxSecurityLayers {
+		switch p.ContentType {
+		case "multipart/signed":
+			w.verifySigned(p)
+			w.walk(p.Parts[0], inRelated)
 			return
+		case "multipart/encrypted":
+			if strings.EqualFold(p.Params["protocol"], "application/pgp-encrypted") && w.decryptPGP(p, inRelated) {
+				return
+			}
 		}
+	}
 
-		email.TextBody = strings.TrimSuffix(string(message[:]), "\n")
-	case contentTypeTextHtml:
-		message, _ := io.ReadAll(msg.Body)
-		var reader io.Reader
-		reader, err = decodeContent(strings.NewReader(string(message[:])), cte)
-		if err != nil {
-			return
+	if p.IsMultipart() {
+		inRelated = inRelated || p.ContentType == contentTypeMultipartRelated
+		for _, child := range p.Parts {
+			w.walk(child, inRelated)
 		}
+		return
+	}
 
-		message, err = io.ReadAll(reader)
-		if err != nil {
-			return
+	data, err := p.Decode(w.data)
+	if err != nil {
+		w.setErr(p, err)
+		data = p.Body(w.data)
+	}
+
+	if isPKCS7Mime(p.ContentType) && w.layers < maxSecurityLayers && w.openPKCS7(p, data, inRelated) {
+		return
+	}
+
+	if isMessage(p.ContentType) && w.depth < maxEmbeddingDepth {
+		em, err := parse(data, w.depth+1, w.keys)
+		w.email.EmbeddedMessages = append(w.email.EmbeddedMessages, EmbeddedMessage{
+			Email: em,
+			Data:  data,
+			Err:   err,
+		})
+	}
+
+	if isCalendar(p.ContentType) {
+		w.parseCalendar(p, data)
+	}
+
+	if isTNEF(p.ContentType, p.Filename) {
+		w.parseTNEF(p, data)
+	}
+
+	isBody := p.Disposition != "attachment" && p.Filename == ""
+	switch {
+	case isBody && p.ContentType == contentTypeTextPlain:
+		text, charset := w.decodeText(p, data, p.Charset)
+		if w.email.TextBody != "" {
+			w.email.TextBody += "\n"
+		}
+		w.email.TextBody += strings.TrimSuffix(text, "\n")
+		if w.email.TextCharset == "" {
+			w.email.TextCharset = charset
+		}
+	case isBody && p.ContentType == contentTypeTextHtml:
+		charset := p.Charset
+		if charset == "" {
+			charset = htmlCharset(data)
 		}
 
-		email.HTMLBody = strings.TrimSuffix(string(message[:]), "\n")
-	case contentTypeOctetStream:
-		email.Attachments, err = parseAttachmentOnlyEmail(msg.Body, msg.Header)
+		html, charset := w.decodeText(p, data, charset)
+		w.email.HTMLBody += strings.TrimSuffix(html, "\n")
+		if w.email.HTMLCharset == "" {
+			w.email.HTMLCharset = charset
+		}
+	case p.Disposition != "attachment" && (inRelated || p.ContentID != ""):
+		w.email.EmbeddedFiles = append(w.email.EmbeddedFiles, EmbeddedFile{
+			CID:         p.ContentID,
+			ContentType: p.ContentType,
+			Charset:     p.Charset,
+			Data:        bytes.NewReader(data),
+		})
 	default:
-		email.Content, err = decodeContent(msg.Body, cte)
+		if p.Path == w.email.Root.Path {
+			w.email.Content = bytes.NewReader(data)
+		}
+
+		w.email.Attachments = append(w.email.Attachments, Attachment{
+			Filename:    p.Filename,
+			CID:         p.ContentID,
+			ContentType: p.ContentType,
+			Charset:     p.Charset,
+			Data:        bytes.NewReader(data),
+		})
 	}
+}
 
-	return
+// decodeText converts the body of a text part to UTF-8, and returns it along
+// with the charset it was converted from. If the charset is not supported,
+// the body is returned as-is.
+func (w *walker) decodeText(p *Part, data []byte, charset string) (string, string) {
+	decoded, err := decodeCharset(data, charset)
+	if err != nil {
+		w.setErr(p, err)
+		return string(data), charset
+	}
+
+	return string(decoded), charset
+}
+
+// parseCalendar adds the events of an iCalendar part to the email. Parts that
+// can't be parsed are kept as attachments, but their events are not stored.
+func (w *walker) parseCalendar(p *Part, data []byte) {
+	data, err := decodeCharset(data, p.Charset)
+	if err != nil {
+		w.setErr(p, err)
+		return
+	}
+
+	events, err := ParseCalendar(data)
+	if err != nil {
+		w.setErr(p, err)
+		return
+	}
+
+	w.email.CalendarEvents = append(w.email.CalendarEvents, events...)
+}
+
+func (w *walker) parseTNEF(p *Part, data []byte) {
+	t, err := ParseTNEF(data)
+	if err != nil {
+		w.setErr(p, err)
+	}
+
+	if t != nil {
+		w.tnef = append(w.tnef, t)
+	}
+}
+
+// applyTNEF adds the bodies and attachments of the TNEF parts to the email,
+// once the other parts have been walked. The bodies are only used if the
+// message doesn't have them outside of the TNEF parts, and the RTF body is
+// added as an attachment.
+func (w *walker) applyTNEF() {
+	for _, t := range w.tnef {
+		w.addTNEF(t)
+	}
+}
+
+func (w *walker) addTNEF(t *TNEF) {
+	if w.email.TextBody == "" && t.TextBody != "" {
+		w.email.TextBody = t.TextBody
+		w.email.TextCharset = t.TextCharset
+	}
+
+	if w.email.HTMLBody == "" && t.HTMLBody != "" {
+		w.email.HTMLBody = t.HTMLBody
+		w.email.HTMLCharset = t.HTMLCharset
+	}
+
+	if len(t.RTFBody) > 0 {
+		w.email.Attachments = append(w.email.Attachments, Attachment{
+			Filename:    "body.rtf",
+			ContentType: contentTypeRTF,
+			Data:        bytes.NewReader(t.RTFBody),
+		})
+	}
+
+	for _, a := range t.Attachments {
+		w.email.Attachments = append(w.email.Attachments, Attachment{
+			Filename:    a.Filename,
+			CID:         a.ContentID,
+			ContentType: a.ContentType,
+			Data:        bytes.NewReader(a.Data),
+		})
+	}
 }
 
 func createEmailFromHeader(header mail.Header) (email Email, err error) {
@@ -121,268 +288,13 @@ func createEmailFromHeader(header mail.Header) (email Email, err error) {
 	return
 }
 
-func parseContentType(contentTypeHeader string) (contentType string, params map[string]string, err error) {
-	if contentTypeHeader == "" {
-		contentType = contentTypeTextPlain
-		return
-	}
-
-	return mime.ParseMediaType(contentTypeHeader)
-}
-
-func parseAttachmentOnlyEmail(body io.Reader, header mail.Header) (attachments []Attachment, err error) {
-	contentDisposition := header.Get("Content-Disposition")
-
-	if len(contentDisposition) > 0 && strings.Contains(contentDisposition, "attachment;") {
-
-		attachmentData, err := decodeContent(body, header.Get("Content-Transfer-Encoding"))
-		if err != nil {
-			return attachments, err
-		}
-
-		fileName := strings.Replace(contentDisposition, "attachment; filename=\"", "", -1)
-		fileName = strings.TrimRight(fileName, "\"")
-
-		at := Attachment{
-			Filename:    fileName,
-			ContentType: "application/octet-stream",
-			Data:        attachmentData,
-		}
-
-		attachments = append(attachments, at)
-	}
-
-	return attachments, nil
-}
-
-func parseMultipartRelated(msg io.Reader, boundary string) (textBody, htmlBody string, embeddedFiles []EmbeddedFile, err error) {
-	pmr := multipart.NewReader(msg, boundary)
-	for {
-		part, err := pmr.NextRawPart()
-
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return textBody, htmlBody, embeddedFiles, err
-		}
-
-		cte := part.Header.Get("Content-Transfer-Encoding")
-
-		contentType, params, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
-		if err != nil {
-			return textBody, htmlBody, embeddedFiles, err
-		}
-
-		switch contentType {
-		case contentTypeTextPlain:
-			decoded, err := decodeContent(part, cte)
-			if err != nil {
-				return textBody, htmlBody, embeddedFiles, err
-			}
-			ppContent, err := io.ReadAll(decoded)
-			if err != nil {
-				return textBody, htmlBody, embeddedFiles, err
-			}
-
-			textBody += strings.TrimSuffix(string(ppContent[:]), "\n")
-		case contentTypeTextHtml:
-			decoded, err := decodeContent(part, cte)
-			if err != nil {
-				return textBody, htmlBody, embeddedFiles, err
-			}
-			ppContent, err := io.ReadAll(decoded)
-			if err != nil {
-				return textBody, htmlBody, embeddedFiles, err
-			}
-
-			htmlBody += strings.TrimSuffix(string(ppContent[:]), "\n")
-		case contentTypeMultipartAlternative:
-			tb, hb, ef, err := parseMultipartAlternative(part, params["boundary"])
-			if err != nil {
-				return textBody, htmlBody, embeddedFiles, err
-			}
-
-			htmlBody += hb
-			textBody += tb
-			embeddedFiles = append(embeddedFiles, ef...)
-		default:
-			if isEmbeddedFile(part) {
-				ef, err := decodeEmbeddedFile(part)
-				if err != nil {
-					return textBody, htmlBody, embeddedFiles, err
-				}
-
-				embeddedFiles = append(embeddedFiles, ef)
-			} else {
-				return textBody, htmlBody, embeddedFiles, fmt.Errorf("can't process multipart/related inner mime type: %s", contentType)
-			}
-		}
-	}
-
-	return textBody, htmlBody, embeddedFiles, err
-}
-
-func parseMultipartAlternative(msg io.Reader, boundary string) (textBody, htmlBody string, embeddedFiles []EmbeddedFile, err error) {
-	pmr := multipart.NewReader(msg, boundary)
-	for {
-		part, err := pmr.NextRawPart()
-
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return textBody, htmlBody, embeddedFiles, err
-		}
-
-		cte := part.Header.Get("Content-Transfer-Encoding")
-
-		contentType, params, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
-		if err != nil {
-			return textBody, htmlBody, embeddedFiles, err
-		}
-
-		switch contentType {
-		case contentTypeTextPlain:
-			decoded, err := decodeContent(part, cte)
-			if err != nil {
-				return textBody, htmlBody, embeddedFiles, err
-			}
-			ppContent, err := io.ReadAll(decoded)
-			if err != nil {
-				return textBody, htmlBody, embeddedFiles, err
-			}
-
-			textBody += strings.TrimSuffix(string(ppContent[:]), "\n")
-		case contentTypeTextHtml:
-			decoded, err := decodeContent(part, cte)
-			if err != nil {
-				return textBody, htmlBody, embeddedFiles, err
-			}
-			ppContent, err := io.ReadAll(decoded)
-			if err != nil {
-				return textBody, htmlBody, embeddedFiles, err
-			}
-
-			htmlBody += strings.TrimSuffix(string(ppContent[:]), "\n")
-		case contentTypeMultipartRelated:
-			tb, hb, ef, err := parseMultipartRelated(part, params["boundary"])
-			if err != nil {
-				return textBody, htmlBody, embeddedFiles, err
-			}
-
-			htmlBody += hb
-			textBody += tb
-			embeddedFiles = append(embeddedFiles, ef...)
-		default:
-			if isEmbeddedFile(part) {
-				ef, err := decodeEmbeddedFile(part)
-				if err != nil {
-					return textBody, htmlBody, embeddedFiles, err
-				}
-
-				embeddedFiles = append(embeddedFiles, ef)
-			} else {
-				return textBody, htmlBody, embeddedFiles, fmt.Errorf("can't process multipart/alternative inner mime type: %s", contentType)
-			}
-		}
-	}
-
-	return textBody, htmlBody, embeddedFiles, err
-}
-
-func parseMultipartMixed(msg io.Reader, boundary string) (textBody, htmlBody string, attachments []Attachment, embeddedFiles []EmbeddedFile, err error) {
-	mr := multipart.NewReader(msg, boundary)
-	for {
-		part, err := mr.NextRawPart()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return textBody, htmlBody, attachments, embeddedFiles, err
-		}
-
-		if isAttachment(part) {
-			at, err := decodeAttachment(part)
-			if err != nil {
-				return textBody, htmlBody, attachments, embeddedFiles, err
-			}
-
-			attachments = append(attachments, at)
-			continue
-		}
-
-		cte := part.Header.Get("Content-Transfer-Encoding")
-
-		contentType, params, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
-		if err != nil {
-			return textBody, htmlBody, attachments, embeddedFiles, err
-		}
-
-		if isAttachment(part) {
-			at, err := decodeAttachment(part)
-			if err != nil {
-				return textBody, htmlBody, attachments, embeddedFiles, err
-			}
-			attachments = append(attachments, at)
-		}
-
-		if contentType == contentTypeMultipartAlternative {
-			textBody, htmlBody, embeddedFiles, err = parseMultipartAlternative(part, params["boundary"])
-			if err != nil {
-				return textBody, htmlBody, attachments, embeddedFiles, err
-			}
-		} else if contentType == contentTypeMultipartRelated {
-			textBody, htmlBody, embeddedFiles, err = parseMultipartRelated(part, params["boundary"])
-			if err != nil {
-				return textBody, htmlBody, attachments, embeddedFiles, err
-			}
-		} else if contentType == contentTypeTextPlain {
-			decoded, err := decodeContent(part, cte)
-			if err != nil {
-				return textBody, htmlBody, attachments, embeddedFiles, err
-			}
-			ppContent, err := io.ReadAll(decoded)
-			if err != nil {
-				return textBody, htmlBody, attachments, embeddedFiles, err
-			}
-
-			textBody += strings.TrimSuffix(string(ppContent[:]), "\n")
-		} else if contentType == contentTypeTextHtml {
-			decoded, err := decodeContent(part, cte)
-			if err != nil {
-				return textBody, htmlBody, attachments, embeddedFiles, err
-			}
-			ppContent, err := io.ReadAll(decoded)
-			if err != nil {
-				return textBody, htmlBody, attachments, embeddedFiles, err
-			}
-
-			htmlBody += strings.TrimSuffix(string(ppContent[:]), "\n")
-		} else {
-			return textBody, htmlBody, attachments, embeddedFiles, fmt.Errorf("unknown multipart/mixed nested mime type: %s", contentType)
-		}
-	}
-
-	return textBody, htmlBody, attachments, embeddedFiles, err
-}
-
 func decodeMimeSentence(s string) string {
-	result := []string{}
-	ss := strings.Split(s, " ")
-
-	for _, word := range ss {
-		dec := new(mime.WordDecoder)
-		w, err := dec.Decode(word)
-		if err != nil {
-			if len(result) == 0 {
-				w = word
-			} else {
-				w = " " + word
-			}
-		}
-
-		result = append(result, w)
+	decoded, err := wordDecoder.DecodeHeader(s)
+	if err != nil {
+		return s
 	}
 
-	return strings.Join(result, "")
+	return decoded
 }
 
 func decodeHeaderMime(header mail.Header) (mail.Header, error) {
@@ -401,42 +313,6 @@ func decodeHeaderMime(header mail.Header) (mail.Header, error) {
 	return mail.Header(parsedHeader), nil
 }
 
-func isEmbeddedFile(part *multipart.Part) bool {
-	return part.Header.Get("Content-Transfer-Encoding") != ""
-}
-
-func decodeEmbeddedFile(part *multipart.Part) (ef EmbeddedFile, err error) {
-	cid := decodeMimeSentence(part.Header.Get("Content-Id"))
-	decoded, err := decodeContent(part, part.Header.Get("Content-Transfer-Encoding"))
-	if err != nil {
-		return
-	}
-
-	ef.CID = strings.Trim(cid, "<>")
-	ef.Data = decoded
-	ef.ContentType = part.Header.Get("Content-Type")
-
-	return
-}
-
-func isAttachment(part *multipart.Part) bool {
-	return part.FileName() != ""
-}
-
-func decodeAttachment(part *multipart.Part) (at Attachment, err error) {
-	filename := decodeMimeSentence(part.FileName())
-	decoded, err := decodeContent(part, part.Header.Get("Content-Transfer-Encoding"))
-	if err != nil {
-		return
-	}
-
-	at.Filename = filename
-	at.Data = decoded
-	at.ContentType = strings.Split(part.Header.Get("Content-Type"), ";")[0]
-
-	return
-}
-
 func decodeContent(content io.Reader, encoding string) (io.Reader, error) {
 	switch strings.ToLower(encoding) {
 	case "base64":
@@ -475,7 +351,7 @@ func (hp *headerParser) parseAddress(s string) (ma *mail.Address) {
 	}
 
 	if strings.Trim(s, " \n") != "" {
-		ma, hp.err = mail.ParseAddress(s)
+		ma, hp.err = addressParser.Parse(s)
 
 		return ma
 	}
@@ -489,7 +365,7 @@ func (hp *headerParser) parseAddressList(s string) (ma []*mail.Address) {
 	}
 
 	if strings.Trim(s, " \n") != "" {
-		ma, hp.err = mail.ParseAddressList(s)
+		ma, hp.err = addressParser.ParseList(s)
 		return
 	}
 
@@ -540,17 +416,29 @@ func (hp *headerParser) parseMessageIdList(s string) (result []string) {
 	return
 }
 
-// Attachment with filename, content type and data (as a io.Reader)
+// Attachment with filename, content id, content type, charset and data (as a
+// io.Reader). The data of text attachments is not converted from their charset.
 type Attachment struct {
 	Filename    string
+	CID         string
 	ContentType string
+	Charset     string
 	Data        io.Reader
 }
 
+// EmbeddedMessage is a message/rfc822 part parsed as a message of its own,
+// with the decoded data of the part and the error encountered when parsing it
+type EmbeddedMessage struct {
+	Email Email
+	Data  []byte
+	Err   error
+}
+
 // EmbeddedFile with content id, content type and data (as a io.Reader)
 type EmbeddedFile struct {
 	CID         string
 	ContentType string
+	Charset     string
 	Data        io.Reader
 }
 
@@ -584,6 +472,19 @@ type Email struct {
 	HTMLBody string
 	TextBody string
 
-	Attachments   []Attachment
-	EmbeddedFiles []EmbeddedFile
+	// charsets that the bodies were converted to UTF-8 from
+	HTMLCharset string
+	TextCharset string
+
+	Attachments      []Attachment
+	EmbeddedFiles    []EmbeddedFile
+	EmbeddedMessages []EmbeddedMessage
+	CalendarEvents   []CalendarEvent
+
+	// Security is the outcome of verifying and decrypting the message, and is
+	// nil if the message is neither signed nor encrypted
+	Security *Security
+
+	// Root is the MIME tree of the message
+	Root *Part
 }
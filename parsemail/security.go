@@ -0,0 +1,421 @@
+package parsemail
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	pgperrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+	"github.com/smallstep/pkcs7"
+)
+
+const (
+	KeyTypeSMIME = "smime"
+	KeyTypePGP   = "pgp"
+)
+
+const (
+	SignatureValid      = "valid"
+	SignatureInvalid    = "invalid"
+	SignatureUntrusted  = "untrusted"
+	SignatureUnknownKey = "unknown_key"
+)
+
+const (
+	EncryptionDecrypted = "decrypted"
+	EncryptionNoKey     = "no_key"
+	EncryptionFailed    = "failed"
+)
+
+// maxSecurityLayers limits how many signed or encrypted layers are unwrapped
+const maxSecurityLayers = 4
+
+var ErrNoKeys = errors.New("no keys found")
+var ErrEncryptedKey = errors.New("passphrase protected keys are not supported")
+
+// Security is the outcome of verifying and decrypting a message. Protocol is
+// KeyTypeSMIME or KeyTypePGP. Signature and Encryption are empty if the
+// message was not signed or encrypted respectively; otherwise they hold one of
+// the Signature* or Encryption* values.
+type Security struct {
+	Protocol   string
+	Signature  string
+	Signer     string
+	Encryption string
+	Error      string
+}
+
+// KeyInfo describes the keys and certificates added to a Keyring.
+type KeyInfo struct {
+	Type    string
+	Private bool
+	Names   []string
+}
+
+// Keyring holds the keys used to decrypt messages, and the certificates and
+// public keys whose signatures are trusted.
+type Keyring struct {
+	certs []*x509.Certificate
+	keys  []crypto.PrivateKey
+	pgp   openpgp.EntityList
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{}
+}
+
+// Add adds PEM encoded certificates and private keys, or an ASCII armored
+// OpenPGP keyring, to the keyring.
+func (k *Keyring) Add(data []byte) (*KeyInfo, error) {
+	if bytes.Contains(data, []byte("-----BEGIN PGP ")) {
+		return k.addPGP(data)
+	}
+
+	return k.addPEM(data)
+}
+
+func (k *Keyring) addPEM(data []byte) (*KeyInfo, error) {
+	info := &KeyInfo{Type: KeyTypeSMIME}
+	var certs []*x509.Certificate
+	var keys []crypto.PrivateKey
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		switch block.Type {
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			certs = append(certs, cert)
+			info.Names = append(info.Names, certName(cert))
+		case "PRIVATE KEY", "RSA PRIVATE KEY", "EC PRIVATE KEY":
+			key, err := parsePrivateKey(block)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+			info.Private = true
+		case "ENCRYPTED PRIVATE KEY":
+			return nil, ErrEncryptedKey
+		}
+	}
+
+	if len(certs) == 0 && len(keys) == 0 {
+		return nil, ErrNoKeys
+	}
+
+	k.certs = append(k.certs, certs...)
+	k.keys = append(k.keys, keys...)
+	return info, nil
+}
+
+func parsePrivateKey(block *pem.Block) (crypto.PrivateKey, error) {
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+}
+
+func (k *Keyring) addPGP(data []byte) (*KeyInfo, error) {
+	entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entities) == 0 {
+		return nil, ErrNoKeys
+	}
+
+	info := &KeyInfo{Type: KeyTypePGP}
+	for _, e := range entities {
+		if e.PrivateKey != nil {
+			if e.PrivateKey.Encrypted {
+				return nil, ErrEncryptedKey
+			}
+			info.Private = true
+		}
+
+		info.Names = append(info.Names, pgpEntityName(e))
+	}
+
+	k.pgp = append(k.pgp, entities...)
+	return info, nil
+}
+
+func certName(cert *x509.Certificate) string {
+	if len(cert.EmailAddresses) > 0 {
+		return cert.EmailAddresses[0]
+	}
+
+	return cert.Subject.String()
+}
+
+func pgpEntityName(e *openpgp.Entity) string {
+	if id := e.PrimaryIdentity(); id != nil {
+		return id.Name
+	}
+
+	return strings.ToUpper(hex.EncodeToString(e.PrimaryKey.Fingerprint))
+}
+
+// canonicalize converts line endings to CRLF, which is the form in which
+// signatures are computed over MIME entities.
+func canonicalize(data []byte) []byte {
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+}
+
+func (w *walker) security(protocol string) *Security {
+	if w.email.Security == nil {
+		w.email.Security = &Security{}
+	}
+
+	w.email.Security.Protocol = protocol
+	return w.email.Security
+}
+
+// walkDecrypted walks a MIME entity that was signed or encrypted in place of
+// the part that contained it.
+func (w *walker) walkDecrypted(p *Part, data []byte, inRelated bool) {
+	root, err := ParseTree(data)
+	if err != nil {
+		w.setErr(p, err)
+		return
+	}
+
+	orig := w.data
+	w.data = data
+	w.layers++
+	w.walk(root, inRelated)
+	w.layers--
+	w.data = orig
+}
+
+// verifySigned verifies a multipart/signed part, whose first part is the
+// signed content and whose second part is the signature.
+func (w *walker) verifySigned(p *Part) {
+	content := canonicalize(p.Parts[0].Raw(w.data))
+	sig, err := p.Parts[1].Decode(w.data)
+	if err != nil {
+		w.setErr(p.Parts[1], err)
+		return
+	}
+
+	switch strings.ToLower(p.Params["protocol"]) {
+	case "application/pkcs7-signature", "application/x-pkcs7-signature":
+		p7, err := pkcs7.Parse(sig)
+		if err != nil {
+			s := w.security(KeyTypeSMIME)
+			s.Signature, s.Error = SignatureInvalid, err.Error()
+			return
+		}
+
+		p7.Content = content
+		w.verifyPKCS7(p7)
+	case "application/pgp-signature":
+		s := w.security(KeyTypePGP)
+		signer, err := openpgp.CheckArmoredDetachedSignature(w.pgpKeys(), bytes.NewReader(content), bytes.NewReader(sig), nil)
+		s.Signature, s.Signer, s.Error = pgpSignatureStatus(signer, err)
+	}
+}
+
+func (w *walker) verifyPKCS7(p7 *pkcs7.PKCS7) {
+	s := w.security(KeyTypeSMIME)
+	if signer := p7.GetOnlySigner(); signer != nil {
+		s.Signer = certName(signer)
+	}
+
+	if err := p7.Verify(); err != nil {
+		s.Signature, s.Error = SignatureInvalid, err.Error()
+		return
+	}
+
+	if w.trusts(p7) {
+		s.Signature, s.Error = SignatureValid, ""
+	} else {
+		s.Signature, s.Error = SignatureUntrusted, ""
+	}
+}
+
+// trusts reports whether the signer of a verified PKCS #7 object is one of
+// the certificates in the keyring, or is issued by one of them.
+func (w *walker) trusts(p7 *pkcs7.PKCS7) bool {
+	if w.keys == nil || len(w.keys.certs) == 0 {
+		return false
+	}
+
+	signer := p7.GetOnlySigner()
+	roots := x509.NewCertPool()
+	for _, cert := range w.keys.certs {
+		if signer != nil && signer.Equal(cert) {
+			return true
+		}
+		roots.AddCert(cert)
+	}
+
+	return p7.VerifyWithChain(roots) == nil
+}
+
+// openPKCS7 unwraps an application/pkcs7-mime part, which is either
+// enveloped (encrypted) or opaque signed data, and reports whether its content
+// was walked in place of the part.
+func (w *walker) openPKCS7(p *Part, data []byte, inRelated bool) bool {
+	p7, err := pkcs7.Parse(data)
+	if err != nil {
+		s := w.security(KeyTypeSMIME)
+		s.Error = err.Error()
+		return false
+	}
+
+	if len(p7.Signers) > 0 {
+		w.verifyPKCS7(p7)
+		w.walkDecrypted(p, p7.Content, inRelated)
+		return true
+	}
+
+	s := w.security(KeyTypeSMIME)
+	if w.keys == nil || len(w.keys.keys) == 0 {
+		s.Encryption = EncryptionNoKey
+		return false
+	}
+
+	for _, key := range w.keys.keys {
+		for _, cert := range w.keys.certs {
+			if !publicKeyMatches(cert, key) {
+				continue
+			}
+
+			plain, err := p7.Decrypt(cert, key)
+			if err != nil {
+				s.Error = err.Error()
+				continue
+			}
+
+			s.Encryption, s.Error = EncryptionDecrypted, ""
+			w.walkDecrypted(p, plain, inRelated)
+			return true
+		}
+	}
+
+	if s.Error == "" {
+		s.Encryption = EncryptionNoKey
+	} else {
+		s.Encryption = EncryptionFailed
+	}
+
+	return false
+}
+
+func isPKCS7Mime(contentType string) bool {
+	return contentType == "application/pkcs7-mime" || contentType == "application/x-pkcs7-mime"
+}
+
+func publicKeyMatches(cert *x509.Certificate, key crypto.PrivateKey) bool {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return false
+	}
+
+	pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	return ok && pub.Equal(cert.PublicKey)
+}
+
+// decryptPGP decrypts a multipart/encrypted part as described in RFC 3156,
+// and reports whether its content was walked in place of the part.
+func (w *walker) decryptPGP(p *Part, inRelated bool) bool {
+	data, err := p.Parts[1].Decode(w.data)
+	if err != nil {
+		w.setErr(p.Parts[1], err)
+		return false
+	}
+
+	s := w.security(KeyTypePGP)
+	block, err := armor.Decode(bytes.NewReader(data))
+	if err != nil {
+		s.Encryption, s.Error = EncryptionFailed, err.Error()
+		return false
+	}
+
+	md, err := openpgp.ReadMessage(block.Body, w.pgpKeys(), nil, nil)
+	if err != nil {
+		if errors.Is(err, pgperrors.ErrKeyIncorrect) {
+			s.Encryption, s.Error = EncryptionNoKey, ""
+		} else {
+			s.Encryption, s.Error = EncryptionFailed, err.Error()
+		}
+		return false
+	}
+
+	// errors in reading the body are from decrypting it or checking its
+	// integrity, since signatures are checked separately in SignatureError
+	plain, err := io.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		s.Encryption, s.Error = EncryptionFailed, err.Error()
+		return false
+	}
+
+	s.Encryption, s.Error = EncryptionDecrypted, ""
+	if md.IsSigned {
+		var signer *openpgp.Entity
+		if md.SignedBy != nil {
+			signer = md.SignedBy.Entity
+		} else {
+			s.Signer = fmt.Sprintf("%016X", md.SignedByKeyId)
+		}
+
+		sigErr := md.SignatureError
+		if md.SignedBy == nil {
+			sigErr = pgperrors.ErrUnknownIssuer
+		}
+
+		status, name, sigMsg := pgpSignatureStatus(signer, sigErr)
+		s.Signature, s.Error = status, sigMsg
+		if name != "" {
+			s.Signer = name
+		}
+	}
+
+	w.walkDecrypted(p, plain, inRelated)
+	return true
+}
+
+func (w *walker) pgpKeys() openpgp.EntityList {
+	if w.keys == nil {
+		return nil
+	}
+
+	return w.keys.pgp
+}
+
+func pgpSignatureStatus(signer *openpgp.Entity, err error) (status, name, msg string) {
+	if signer != nil {
+		name = pgpEntityName(signer)
+	}
+
+	switch {
+	case err == nil:
+		return SignatureValid, name, ""
+	case errors.Is(err, pgperrors.ErrUnknownIssuer):
+		return SignatureUnknownKey, name, ""
+	default:
+		return SignatureInvalid, name, err.Error()
+	}
+}
@@ -0,0 +1,543 @@
+package parsemail
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"mime"
+	"path"
+	"strconv"
+	"unicode/utf16"
+)
+
+const (
+	contentTypeTNEF        = "application/ms-tnef"
+	contentTypeVndTNEF     = "application/vnd.ms-tnef"
+	contentTypeRTF         = "application/rtf"
+	contentTypeOctetStream = "application/octet-stream"
+)
+
+const tnefSignature = 0x223e9f78
+
+// TNEF attribute ids, including their type in the upper 16 bits
+const (
+	attBody           = 0x0002800c
+	attAttachData     = 0x0006800f
+	attAttachTitle    = 0x00018010
+	attMAPIProps      = 0x00069003
+	attAttachRenddata = 0x00069002
+	attAttachment     = 0x00069005
+	attOemCodepage    = 0x00069007
+)
+
+// MAPI property ids
+const (
+	propBody             = 0x1000
+	propRTFCompressed    = 0x1009
+	propBodyHTML         = 0x1013
+	propDisplayName      = 0x3001
+	propAttachDataBin    = 0x3701
+	propAttachFilename   = 0x3704
+	propAttachLongName   = 0x3707
+	propAttachMimeTag    = 0x370e
+	propAttachContentId  = 0x3712
+	propInternetCodepage = 0x3fde
+)
+
+// MAPI property types
+const (
+	ptShort    = 0x0002
+	ptLong     = 0x0003
+	ptFloat    = 0x0004
+	ptDouble   = 0x0005
+	ptCurrency = 0x0006
+	ptAppTime  = 0x0007
+	ptError    = 0x000a
+	ptBoolean  = 0x000b
+	ptObject   = 0x000d
+	ptI8       = 0x0014
+	ptString8  = 0x001e
+	ptUnicode  = 0x001f
+	ptSysTime  = 0x0040
+	ptClsid    = 0x0048
+	ptBinary   = 0x0102
+	ptMulti    = 0x1000
+)
+
+var ErrInvalidTNEF = errors.New("invalid TNEF data")
+
+// TNEF is the content of a TNEF (winmail.dat) part, as described in
+// MS-OXTNEF. The bodies are converted to UTF-8 from the charsets given by
+// TextCharset and HTMLCharset, except for the RTF body which is decompressed
+// but otherwise returned as-is.
+type TNEF struct {
+	TextBody    string
+	TextCharset string
+	HTMLBody    string
+	HTMLCharset string
+	RTFBody     []byte
+	Attachments []TNEFAttachment
+}
+
+type TNEFAttachment struct {
+	Filename    string
+	ContentType string
+	ContentID   string
+	Data        []byte
+}
+
+type mapiProp struct {
+	id    uint16
+	typ   uint16
+	value []byte
+}
+
+// tnefReader reads little-endian values, and records an error instead of
+// panicking when the data is truncated.
+type tnefReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *tnefReader) bytes(n int) []byte {
+	if r.err != nil || n < 0 || r.pos+n > len(r.data) {
+		r.err = ErrInvalidTNEF
+		return nil
+	}
+
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *tnefReader) uint8() uint8 {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *tnefReader) uint16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *tnefReader) uint32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *tnefReader) pad() {
+	if rem := r.pos % 4; rem != 0 {
+		r.bytes(4 - rem)
+	}
+}
+
+func (r *tnefReader) done() bool {
+	return r.err != nil || r.pos >= len(r.data)
+}
+
+func isTNEF(contentType, filename string) bool {
+	return contentType == contentTypeTNEF || contentType == contentTypeVndTNEF ||
+		(contentType == contentTypeOctetStream && filename == "winmail.dat")
+}
+
+// ParseTNEF decodes the bodies and attachments of a TNEF stream. Attachments
+// that were read before an error is encountered are returned along with it.
+func ParseTNEF(data []byte) (*TNEF, error) {
+	r := &tnefReader{data: data}
+	if r.uint32() != tnefSignature {
+		return nil, ErrInvalidTNEF
+	}
+	r.uint16() // legacy key
+
+	result := &TNEF{}
+	charset := "windows-1252"
+	var attachment *TNEFAttachment
+	var attachTitle string
+
+	finishAttachment := func() {
+		if attachment == nil {
+			return
+		}
+
+		if attachment.Filename == "" {
+			attachment.Filename = attachTitle
+		}
+		attachment.Filename = sanitizeFilename(attachment.Filename)
+
+		if attachment.ContentType == "" {
+			attachment.ContentType = mime.TypeByExtension(path.Ext(attachment.Filename))
+		}
+		if attachment.ContentType == "" {
+			attachment.ContentType = contentTypeOctetStream
+		}
+
+		if ct, _, err := mime.ParseMediaType(attachment.ContentType); err == nil {
+			attachment.ContentType = ct
+		}
+
+		result.Attachments = append(result.Attachments, *attachment)
+		attachment, attachTitle = nil, ""
+	}
+
+	for !r.done() {
+		r.uint8() // level
+		id := r.uint32()
+		value := r.bytes(int(r.uint32()))
+		r.uint16() // checksum
+		if r.err != nil {
+			break
+		}
+
+		switch id {
+		case attOemCodepage:
+			if len(value) >= 4 {
+				if cs := codepageCharset(binary.LittleEndian.Uint32(value)); cs != "" {
+					charset = cs
+				}
+			}
+		case attBody:
+			if result.TextBody == "" {
+				result.TextBody = decodeString8(value, charset)
+				result.TextCharset = charset
+			}
+		case attAttachRenddata:
+			finishAttachment()
+			attachment = &TNEFAttachment{}
+		case attAttachTitle:
+			attachTitle = decodeString8(value, charset)
+		case attAttachData:
+			if attachment != nil {
+				attachment.Data = value
+			}
+		case attMAPIProps:
+			props, err := parseMAPIProps(value)
+			if err != nil {
+				finishAttachment()
+				return result, err
+			}
+			result.applyMessageProps(props, charset)
+		case attAttachment:
+			if attachment == nil {
+				continue
+			}
+
+			props, err := parseMAPIProps(value)
+			if err != nil {
+				finishAttachment()
+				return result, err
+			}
+			attachment.applyProps(props, charset)
+		}
+	}
+
+	finishAttachment()
+	return result, r.err
+}
+
+func (t *TNEF) applyMessageProps(props []mapiProp, charset string) {
+	htmlCharset := charset
+	for _, p := range props {
+		if p.id == propInternetCodepage && p.typ == ptLong && len(p.value) >= 4 {
+			if cs := codepageCharset(binary.LittleEndian.Uint32(p.value)); cs != "" {
+				htmlCharset = cs
+			}
+		}
+	}
+
+	for _, p := range props {
+		switch p.id {
+		case propBody:
+			t.TextBody, t.TextCharset = propString(p, charset), propCharset(p, charset)
+		case propBodyHTML:
+			// PR_HTML is binary, and is in the charset of the internet codepage
+			t.HTMLBody, t.HTMLCharset = propString(p, htmlCharset), propCharset(p, htmlCharset)
+		case propRTFCompressed:
+			if rtf, err := decompressRTF(p.value); err == nil {
+				t.RTFBody = rtf
+			}
+		}
+	}
+}
+
+func (a *TNEFAttachment) applyProps(props []mapiProp, charset string) {
+	var filename, longFilename, displayName string
+	for _, p := range props {
+		switch p.id {
+		case propAttachLongName:
+			longFilename = propString(p, charset)
+		case propAttachFilename:
+			filename = propString(p, charset)
+		case propDisplayName:
+			displayName = propString(p, charset)
+		case propAttachMimeTag:
+			a.ContentType = propString(p, charset)
+		case propAttachContentId:
+			a.ContentID = propString(p, charset)
+		case propAttachDataBin:
+			if a.Data == nil {
+				a.Data = p.value
+			}
+		}
+	}
+
+	for _, name := range []string{longFilename, filename, displayName} {
+		if name != "" {
+			a.Filename = name
+			break
+		}
+	}
+}
+
+// parseMAPIProps parses an encoded list of MAPI properties. Multi-valued
+// properties are returned with their first value.
+func parseMAPIProps(data []byte) ([]mapiProp, error) {
+	r := &tnefReader{data: data}
+	count := r.uint32()
+
+	var props []mapiProp
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		typ := r.uint16()
+		id := r.uint16()
+
+		// named properties are identified by a GUID and a number or name
+		if id >= 0x8000 {
+			r.bytes(16)
+			if r.uint32() == 0 {
+				r.uint32()
+			} else {
+				r.bytes(int(r.uint32()))
+				r.pad()
+			}
+		}
+
+		baseType := typ &^ ptMulti
+		variable := baseType == ptString8 || baseType == ptUnicode || baseType == ptBinary || baseType == ptObject
+
+		// variable length properties have a count even if they're single-valued
+		values := 1
+		if typ&ptMulti != 0 || variable {
+			values = int(r.uint32())
+		}
+
+		var first []byte
+		for j := 0; j < values && r.err == nil; j++ {
+			var v []byte
+			switch baseType {
+			case ptShort, ptBoolean:
+				if b := r.bytes(4); b != nil {
+					v = b[:2]
+				}
+			case ptLong, ptFloat, ptError:
+				v = r.bytes(4)
+			case ptDouble, ptCurrency, ptAppTime, ptI8, ptSysTime:
+				v = r.bytes(8)
+			case ptClsid:
+				v = r.bytes(16)
+			case ptString8, ptUnicode, ptBinary, ptObject:
+				v = r.bytes(int(r.uint32()))
+				r.pad()
+				if baseType == ptObject && len(v) >= 16 {
+					// skip the interface identifier
+					v = v[16:]
+				}
+			default:
+				return props, ErrInvalidTNEF
+			}
+
+			if j == 0 {
+				first = v
+			}
+		}
+
+		if r.err != nil {
+			return props, r.err
+		}
+
+		props = append(props, mapiProp{id: id, typ: baseType, value: first})
+	}
+
+	return props, r.err
+}
+
+func propString(p mapiProp, charset string) string {
+	switch p.typ {
+	case ptUnicode:
+		return decodeUTF16(p.value)
+	case ptString8, ptBinary:
+		return decodeString8(p.value, charset)
+	}
+
+	return ""
+}
+
+func propCharset(p mapiProp, charset string) string {
+	if p.typ == ptUnicode {
+		return "utf-16le"
+	}
+
+	return charset
+}
+
+func decodeString8(data []byte, charset string) string {
+	data = bytes.TrimRight(data, "\x00")
+	if decoded, err := decodeCharset(data, charset); err == nil {
+		return string(decoded)
+	}
+
+	return string(data)
+}
+
+func decodeUTF16(data []byte) string {
+	u := make([]uint16, len(data)/2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(data[i*2:])
+	}
+
+	for len(u) > 0 && u[len(u)-1] == 0 {
+		u = u[:len(u)-1]
+	}
+
+	return string(utf16.Decode(u))
+}
+
+// codepageCharset returns the charset for a Windows codepage number.
+func codepageCharset(cp uint32) string {
+	switch {
+	case cp >= 1250 && cp <= 1258:
+		return "windows-" + strconv.Itoa(int(cp))
+	case cp >= 28591 && cp <= 28605:
+		return "iso-8859-" + strconv.Itoa(int(cp-28590))
+	}
+
+	switch cp {
+	case 437, 850:
+		return "windows-1252"
+	case 866:
+		return "ibm866"
+	case 874:
+		return "windows-874"
+	case 932:
+		return "shift_jis"
+	case 936:
+		return "gbk"
+	case 949:
+		return "euc-kr"
+	case 950:
+		return "big5"
+	case 20866:
+		return "koi8-r"
+	case 21866:
+		return "koi8-u"
+	case 50220:
+		return "iso-2022-jp"
+	case 51932:
+		return "euc-jp"
+	case 54936:
+		return "gb18030"
+	case 65001:
+		return "utf-8"
+	}
+
+	return ""
+}
+
+// rtfPrebuf is the initial contents of the dictionary used by the compressed
+// RTF format described in MS-OXRTFCP.
+const rtfPrebuf = "{\\rtf1\\ansi\\mac\\deff0\\deftab720{\\fonttbl;}" +
+	"{\\f0\\fnil \\froman \\fswiss \\fmodern \\fscript \\fdecor MS Sans SerifSymbolArialTimes New RomanCourier" +
+	"{\\colortbl\\red0\\green0\\blue0\r\n\\par \\pard\\plain\\f0\\fs20\\b\\i\\u\\tab\\tx"
+
+const (
+	rtfCompressed   = 0x75465a4c // "LZFu"
+	rtfUncompressed = 0x414c454d // "MELA"
+
+	// maxRTFSize limits the size of decompressed RTF, regardless of the size
+	// claimed in its header.
+	maxRTFSize = 16 * 1024 * 1024
+
+	// rtfMaxRatio is the most that compressed RTF can expand by: every
+	// 17 bytes of input, a control byte and 8 references, give up to 136
+	// bytes of output.
+	rtfMaxRatio = 8
+)
+
+// decompressRTF decompresses a PR_RTF_COMPRESSED property.
+func decompressRTF(data []byte) ([]byte, error) {
+	r := &tnefReader{data: data}
+	compSize := r.uint32()
+	rawSize := r.uint32()
+	compType := r.uint32()
+	r.uint32() // crc
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	end := len(data)
+	if int(compSize)+4 < end {
+		end = int(compSize) + 4
+	}
+
+	if compType == rtfUncompressed {
+		if 16+int(rawSize) > end {
+			return nil, ErrInvalidTNEF
+		}
+		return data[16 : 16+rawSize], nil
+	}
+
+	if compType != rtfCompressed {
+		return nil, ErrInvalidTNEF
+	}
+
+	var dict [4096]byte
+	copy(dict[:], rtfPrebuf)
+	wp := len(rtfPrebuf)
+
+	// the output is never larger than the input allows, so a huge size in
+	// the header can't make us allocate more than that
+	limit := int(min(rawSize, maxRTFSize))
+	out := make([]byte, 0, min(limit, max(end-16, 0)*rtfMaxRatio))
+	pos := 16
+	for pos < end && len(out) < limit {
+		control := data[pos]
+		pos++
+
+		for bit := 0; bit < 8 && pos < end && len(out) < limit; bit++ {
+			if control&(1<<bit) == 0 {
+				out = append(out, data[pos])
+				dict[wp] = data[pos]
+				wp = (wp + 1) % len(dict)
+				pos++
+				continue
+			}
+
+			if pos+1 >= end {
+				return out, nil
+			}
+
+			ref := int(data[pos])<<8 | int(data[pos+1])
+			pos += 2
+
+			offset := ref >> 4
+			length := ref&0xf + 2
+			if offset == wp {
+				return out, nil
+			}
+
+			for i := 0; i < length && len(out) < limit; i++ {
+				b := dict[(offset+i)%len(dict)]
+				out = append(out, b)
+				dict[wp] = b
+				wp = (wp + 1) % len(dict)
+			}
+		}
+	}
+
+	return out, nil
+}
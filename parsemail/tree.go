@@ -0,0 +1,273 @@
+package parsemail
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+const maxTreeDepth = 32
+
+var ErrPartNotFound = errors.New("part not found")
+
+// Part is a node in the MIME tree of a message. The offsets are relative to
+// the start of the data passed to ParseTree: Offset is where the headers of
+// the part start, BodyOffset is where its body starts, and End is where the
+// part ends (excluding the line break before the next boundary, if any).
+type Part struct {
+	Path             string
+	Header           textproto.MIMEHeader
+	ContentType      string
+	Params           map[string]string
+	Charset          string
+	TransferEncoding string
+	Disposition      string
+	Filename         string
+	ContentID        string
+	Offset           int
+	BodyOffset       int
+	End              int
+	Parts            []*Part
+}
+
+// ParseTree parses a raw message into its MIME tree. The root part is the
+// message itself and has the path "1"; the children of a part with path P are
+// numbered P.1, P.2 and so on.
+func ParseTree(data []byte) (*Part, error) {
+	return parsePart(data, 0, len(data), "1", contentTypeTextPlain, 0)
+}
+
+// Find returns the part with the given path in the tree rooted at p.
+func (p *Part) Find(path string) (*Part, error) {
+	if path == p.Path {
+		return p, nil
+	}
+
+	for _, child := range p.Parts {
+		if path == child.Path || strings.HasPrefix(path, child.Path+".") {
+			return child.Find(path)
+		}
+	}
+
+	return nil, ErrPartNotFound
+}
+
+func (p *Part) IsMultipart() bool {
+	return strings.HasPrefix(p.ContentType, "multipart/")
+}
+
+func isMessage(contentType string) bool {
+	return contentType == "message/rfc822" || contentType == "message/global"
+}
+
+func isIdentityEncoding(encoding string) bool {
+	switch encoding {
+	case "", "7bit", "8bit", "binary":
+		return true
+	}
+
+	return false
+}
+
+// Raw returns the part exactly as it appears in the message, including its
+// headers.
+func (p *Part) Raw(data []byte) []byte {
+	return data[p.Offset:p.End]
+}
+
+// Body returns the body of the part without decoding it.
+func (p *Part) Body(data []byte) []byte {
+	return data[p.BodyOffset:p.End]
+}
+
+// Decode returns the body of the part with the transfer encoding removed.
+func (p *Part) Decode(data []byte) ([]byte, error) {
+	r, err := decodeContent(bytes.NewReader(p.Body(data)), p.TransferEncoding)
+	if err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(r)
+}
+
+func parsePart(data []byte, start, end int, path, defaultType string, depth int) (*Part, error) {
+	bodyStart, hasBlankLine := findHeaderEnd(data, start, end)
+	header, err := readHeader(data[start:bodyStart], hasBlankLine)
+	if err != nil {
+		if start == 0 {
+			return nil, err
+		}
+
+		// treat the part as a body without headers
+		header = textproto.MIMEHeader{}
+		bodyStart = start
+	}
+
+	p := &Part{
+		Path:       path,
+		Header:     header,
+		Offset:     start,
+		BodyOffset: bodyStart,
+		End:        end,
+	}
+
+	p.ContentType, p.Params = parseContentTypeLenient(header.Get("Content-Type"), defaultType)
+	p.Charset = strings.ToLower(p.Params["charset"])
+	p.TransferEncoding = strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding")))
+	p.ContentID = strings.Trim(header.Get("Content-Id"), "<> ")
+
+	if cd := header.Get("Content-Disposition"); cd != "" {
+		p.Disposition, _ = parseContentTypeLenient(cd, "")
+	}
+
+	p.Filename = partFilename(header, p.Charset)
+
+	// the parts of embedded messages are only part of the tree if they can be
+	// addressed by offsets in the original data
+	if isMessage(p.ContentType) && depth < maxTreeDepth && isIdentityEncoding(p.TransferEncoding) {
+		child, err := parsePart(data, bodyStart, end, path+".1", contentTypeTextPlain, depth+1)
+		if err == nil {
+			p.Parts = append(p.Parts, child)
+		}
+	}
+
+	if p.IsMultipart() && depth < maxTreeDepth && p.Params["boundary"] != "" {
+		childType := contentTypeTextPlain
+		if p.ContentType == "multipart/digest" {
+			childType = "message/rfc822"
+		}
+
+		for i, r := range splitMultipart(data, bodyStart, end, p.Params["boundary"]) {
+			childPath := path + "." + strconv.Itoa(i+1)
+			child, err := parsePart(data, r[0], r[1], childPath, childType, depth+1)
+			if err != nil {
+				return nil, err
+			}
+
+			p.Parts = append(p.Parts, child)
+		}
+	}
+
+	return p, nil
+}
+
+// findHeaderEnd returns the offset of the body of the part that starts at
+// start, and whether the headers were terminated by a blank line.
+func findHeaderEnd(data []byte, start, end int) (int, bool) {
+	pos := start
+	for pos < end {
+		lineEnd := bytes.IndexByte(data[pos:end], '\n')
+		if lineEnd < 0 {
+			return end, false
+		}
+
+		line := data[pos : pos+lineEnd+1]
+		pos += lineEnd + 1
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return pos, true
+		}
+	}
+
+	return end, false
+}
+
+func readHeader(raw []byte, hasBlankLine bool) (textproto.MIMEHeader, error) {
+	if !hasBlankLine {
+		raw = append(append([]byte{}, raw...), "\r\n\r\n"...)
+	}
+
+	tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(raw)))
+	header, err := tp.ReadMIMEHeader()
+	if err != nil && (err != io.EOF || len(header) == 0) {
+		return header, err
+	}
+
+	return header, nil
+}
+
+// parseContentTypeLenient parses a Content-Type or Content-Disposition value,
+// falling back to a lenient parser when the parameters are malformed.
+func parseContentTypeLenient(value, defaultType string) (string, map[string]string) {
+	if strings.TrimSpace(value) == "" {
+		return defaultType, map[string]string{}
+	}
+
+	mediaType, params, err := mime.ParseMediaType(value)
+	if err == nil {
+		return mediaType, params
+	}
+
+	mediaType, _, _ = strings.Cut(value, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if mediaType == "" {
+		mediaType = defaultType
+	}
+
+	return mediaType, parseParams(value)
+}
+
+// splitMultipart returns the start and end offsets of each body part in a
+// multipart body. The preamble and epilogue are not included, and a missing
+// close delimiter is tolerated.
+func splitMultipart(data []byte, start, end int, boundary string) [][2]int {
+	delim := []byte("--" + boundary)
+	var ranges [][2]int
+	partStart := -1
+
+	pos := start
+	for pos < end {
+		lineEnd := bytes.IndexByte(data[pos:end], '\n')
+		next := end
+		if lineEnd >= 0 {
+			next = pos + lineEnd + 1
+		}
+
+		line := data[pos:next]
+		if bytes.HasPrefix(line, delim) {
+			rest := line[len(delim):]
+			isClose := bytes.HasPrefix(rest, []byte("--"))
+			if isClose {
+				rest = rest[2:]
+			}
+
+			if len(bytes.TrimRight(rest, " \t\r\n")) == 0 {
+				if partStart >= 0 {
+					ranges = append(ranges, [2]int{partStart, trimLineBreak(data, partStart, pos)})
+				}
+
+				if isClose {
+					return ranges
+				}
+
+				partStart = next
+			}
+		}
+
+		pos = next
+	}
+
+	if partStart >= 0 {
+		ranges = append(ranges, [2]int{partStart, end})
+	}
+
+	return ranges
+}
+
+// trimLineBreak removes the line break preceding a boundary delimiter, since
+// it is considered to be part of the delimiter.
+func trimLineBreak(data []byte, start, end int) int {
+	if end-start >= 2 && data[end-2] == '\r' && data[end-1] == '\n' {
+		return end - 2
+	}
+
+	if end-start >= 1 && data[end-1] == '\n' {
+		return end - 1
+	}
+
+	return end
+}
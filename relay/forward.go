@@ -0,0 +1,136 @@
+package relay
+
+import (
+	"log"
+	"regexp"
+
+	ent "github.com/supriyo-biswas/postbox/entities"
+	"gorm.io/gorm"
+)
+
+// Forward relays the stored raw source of an email to the given address, and
+// records the outcome as a delivery on the email.
+func (r *Relay) Forward(db *gorm.DB, email *ent.Email, to string, ruleId *int64) (*ent.Delivery, error) {
+	var raw ent.EmailContent
+	err := db.Where("email_id = ? AND relationship = ?", email.Id, ent.RelRaw).First(&raw).Error
+	if err != nil {
+		return nil, err
+	}
+
+	delivery := ent.Delivery{
+		EmailId:   email.Id,
+		RuleId:    ruleId,
+		Recipient: to,
+		Status:    ent.DeliverySent,
+	}
+
+	if err := r.Send(email.MailFrom, []string{to}, raw.Content); err != nil {
+		delivery.Status = ent.DeliveryFailed
+		delivery.Error = err.Error()
+	}
+
+	if err := db.Create(&delivery).Error; err != nil {
+		return nil, err
+	}
+
+	return &delivery, nil
+}
+
+// Rule is a forward rule with its patterns compiled. Empty patterns are nil,
+// and match everything.
+type Rule struct {
+	*ent.ForwardRule
+	subject *regexp.Regexp
+	from    *regexp.Regexp
+	to      *regexp.Regexp
+}
+
+// CompileRule compiles the patterns of a forward rule, and returns an error
+// if any of them is invalid.
+func CompileRule(rule *ent.ForwardRule) (*Rule, error) {
+	var err error
+	compiled := &Rule{ForwardRule: rule}
+	if compiled.subject, err = compilePattern(rule.MatchSubject); err != nil {
+		return nil, err
+	}
+
+	if compiled.from, err = compilePattern(rule.MatchFrom); err != nil {
+		return nil, err
+	}
+
+	if compiled.to, err = compilePattern(rule.MatchTo); err != nil {
+		return nil, err
+	}
+
+	return compiled, nil
+}
+
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+
+	return regexp.Compile(pattern)
+}
+
+// AutoForward relays an email to the recipients of every forward rule of its
+// inbox that matches it. The email must have its addresses loaded.
+func (r *Relay) AutoForward(db *gorm.DB, email *ent.Email) {
+	var rules []ent.ForwardRule
+	if err := db.Where("inbox_id = ?", email.InboxId).Find(&rules).Error; err != nil {
+		log.Printf("failed to get forward rules for inbox %d: %s", email.InboxId, err)
+		return
+	}
+
+	for i := range rules {
+		rule, err := CompileRule(&rules[i])
+		if err != nil {
+			log.Printf("failed to compile forward rule %d: %s", rules[i].Id, err)
+			continue
+		}
+
+		if !rule.Match(email) {
+			continue
+		}
+
+		d, err := r.Forward(db, email, rule.Recipient, &rule.Id)
+		if err != nil {
+			log.Printf("failed to forward email %d to %s: %s", email.Id, rule.Recipient, err)
+		} else if d.Status == ent.DeliveryFailed {
+			log.Printf("failed to forward email %d to %s: %s", email.Id, rule.Recipient, d.Error)
+		}
+	}
+}
+
+// Match reports whether an email satisfies all the patterns of a rule.
+func (r *Rule) Match(email *ent.Email) bool {
+	if !matchPattern(r.subject, email.Subject) {
+		return false
+	}
+
+	from := []string{email.MailFrom}
+	var to []string
+	for _, a := range email.Addresses {
+		if a.Type == ent.FromAddr {
+			from = append(from, a.Address)
+		} else {
+			to = append(to, a.Address)
+		}
+	}
+
+	return matchPattern(r.from, from...) && matchPattern(r.to, to...)
+}
+
+func matchPattern(re *regexp.Regexp, values ...string) bool {
+	if re == nil {
+		return true
+	}
+
+	for _, v := range values {
+		if re.MatchString(v) {
+			return true
+		}
+	}
+
+	return false
+}
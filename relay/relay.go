@@ -0,0 +1,234 @@
+package relay
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/supriyo-biswas/postbox/dkim"
+)
+
+const (
+	TLSNone     = "none"
+	TLSStartTLS = "starttls"
+	TLSImplicit = "tls"
+)
+
+const dialTimeout = 30 * time.Second
+const sessionTimeout = 5 * time.Minute
+
+var ErrInvalidTLSMode = errors.New("invalid relay TLS mode")
+
+type Relay struct {
+	host      string
+	port      int
+	username  string
+	password  string
+	tlsMode   string
+	tlsConfig *tls.Config
+	mailFrom  string
+	heloName  string
+	signers   []*dkim.Signer
+}
+
+func NewRelay(host string, port int, username, password, tlsMode string, insecureSkipVerify bool) (*Relay, error) {
+	switch tlsMode {
+	case "":
+		tlsMode = TLSStartTLS
+	case TLSNone, TLSStartTLS, TLSImplicit:
+	default:
+		return nil, ErrInvalidTLSMode
+	}
+
+	if port == 0 {
+		if tlsMode == TLSImplicit {
+			port = 465
+		} else {
+			port = 25
+		}
+	}
+
+	r := &Relay{
+		host:     host,
+		port:     port,
+		username: username,
+		password: password,
+		tlsMode:  tlsMode,
+		tlsConfig: &tls.Config{
+			ServerName:         host,
+			InsecureSkipVerify: insecureSkipVerify,
+		},
+		heloName: "localhost",
+	}
+
+	return r, nil
+}
+
+// SetMailFrom overrides the envelope sender used for relayed messages.
+// By default, the envelope sender of the original message is reused.
+func (r *Relay) SetMailFrom(addr string) {
+	r.mailFrom = addr
+}
+
+func (r *Relay) SetHeloName(name string) {
+	if name != "" {
+		r.heloName = name
+	}
+}
+
+// AddSigner adds a DKIM signer that is applied to every relayed message.
+// When multiple signers are added, each of them adds its own signature.
+func (r *Relay) AddSigner(s *dkim.Signer) {
+	r.signers = append(r.signers, s)
+}
+
+func (r *Relay) dial() (*smtp.Client, error) {
+	addr := net.JoinHostPort(r.host, strconv.Itoa(r.port))
+	dialer := &net.Dialer{Timeout: dialTimeout}
+
+	var conn net.Conn
+	var err error
+	if r.tlsMode == TLSImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, r.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(sessionTimeout))
+	c, err := smtp.NewClient(conn, r.host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Send delivers a message to the upstream server. The data must be a complete
+// RFC 5322 message, and is sent as-is apart from any DKIM signatures.
+func (r *Relay) Send(from string, to []string, data []byte) error {
+	if r.mailFrom != "" {
+		from = r.mailFrom
+	}
+
+	for _, signer := range r.signers {
+		signed, err := signer.Sign(data)
+		if err != nil {
+			return fmt.Errorf("failed to sign message: %w", err)
+		}
+		data = signed
+	}
+
+	c, err := r.dial()
+	if err != nil {
+		return fmt.Errorf("failed to connect to relay: %w", err)
+	}
+	defer c.Close()
+
+	if err := c.Hello(r.heloName); err != nil {
+		return err
+	}
+
+	if r.tlsMode == TLSStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("relay does not support STARTTLS")
+		}
+
+		if err := c.StartTLS(r.tlsConfig); err != nil {
+			return err
+		}
+	}
+
+	if r.username != "" {
+		ok, mechs := c.Extension("AUTH")
+		if !ok {
+			return errors.New("relay does not support authentication")
+		}
+
+		var auth smtp.Auth
+		if strings.Contains(strings.ToUpper(mechs), "PLAIN") {
+			auth = &plainAuth{r.username, r.password}
+		} else {
+			auth = &loginAuth{r.username, r.password}
+		}
+
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+
+	for _, addr := range to {
+		if err := c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+// plainAuth is like smtp.PlainAuth, but does not refuse to authenticate over
+// unencrypted connections, since test relays frequently don't support TLS.
+type plainAuth struct {
+	username, password string
+}
+
+func (a *plainAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	return "PLAIN", []byte("\x00" + a.username + "\x00" + a.password), nil
+}
+
+func (a *plainAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		return nil, errors.New("unexpected server challenge")
+	}
+	return nil, nil
+}
+
+type loginAuth struct {
+	username, password string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("unexpected server challenge: %s", fromServer)
+	}
+}
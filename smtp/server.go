@@ -4,6 +4,10 @@ import (
 	"crypto/tls"
 	"net"
 
+	"github.com/supriyo-biswas/postbox/fts"
+	"github.com/supriyo-biswas/postbox/hub"
+	"github.com/supriyo-biswas/postbox/relay"
+	"github.com/supriyo-biswas/postbox/webhook"
 	"gorm.io/gorm"
 )
 
@@ -11,16 +15,36 @@ type Server struct {
 	db          *gorm.DB
 	cert        *tls.Certificate
 	maxMsgBytes int
+	relay       *relay.Relay
+	hub         *hub.Hub
+	webhooks    *webhook.Dispatcher
+	index       *fts.Index
 }
 
 func NewServer(db *gorm.DB, cert *tls.Certificate, maxMsgBytes int) *Server {
-	return &Server{db, cert, maxMsgBytes}
+	return &Server{db: db, cert: cert, maxMsgBytes: maxMsgBytes}
 }
 
 func (s *Server) SetCertificate(cert *tls.Certificate) {
 	s.cert = cert
 }
 
+func (s *Server) SetRelay(r *relay.Relay) {
+	s.relay = r
+}
+
+func (s *Server) SetHub(h *hub.Hub) {
+	s.hub = h
+}
+
+func (s *Server) SetWebhooks(d *webhook.Dispatcher) {
+	s.webhooks = d
+}
+
+func (s *Server) SetSearchIndex(idx *fts.Index) {
+	s.index = idx
+}
+
 func (s *Server) Serve(ln net.Listener) error {
 	for {
 		conn, err := ln.Accept()
@@ -29,6 +53,10 @@ func (s *Server) Serve(ln net.Listener) error {
 		}
 
 		session := newSession(conn, s.cert, s.maxMsgBytes, s.db)
+		session.relay = s.relay
+		session.hub = s.hub
+		session.webhooks = s.webhooks
+		session.index = s.index
 		go session.handle()
 	}
 }
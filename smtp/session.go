@@ -14,8 +14,12 @@ import (
 	"strings"
 
 	ent "github.com/supriyo-biswas/postbox/entities"
+	"github.com/supriyo-biswas/postbox/fts"
+	"github.com/supriyo-biswas/postbox/hub"
 	"github.com/supriyo-biswas/postbox/parsemail"
+	"github.com/supriyo-biswas/postbox/relay"
 	"github.com/supriyo-biswas/postbox/utils"
+	"github.com/supriyo-biswas/postbox/webhook"
 	"gorm.io/gorm"
 )
 
@@ -53,6 +57,10 @@ type session struct {
 	isTls       bool
 	maxMsgBytes int
 	db          *gorm.DB
+	relay       *relay.Relay
+	hub         *hub.Hub
+	webhooks    *webhook.Dispatcher
+	index       *fts.Index
 	rw          *bufio.ReadWriter
 	heloDone    bool
 	inbox       int64
@@ -192,12 +200,9 @@ func (s *session) handleRcpt(args string) error {
 	return s.send(okResp)
 }
 
-func (s *session) saveEmail(data []byte, inbox int64) error {
-	e, err := parsemail.Parse(bytes.NewReader(data))
-	if err != nil {
-		log.Printf("failed to parse email from %s: %s", s.conn.RemoteAddr().String(), err)
-	}
-
+// buildEmail converts a parsed email into an entity. The messages embedded in
+// it are saved separately by createEmail.
+func (s *session) buildEmail(e *parsemail.Email, data []byte, inbox int64, parseErr error) ent.Email {
 	addr := make([]ent.Address, len(e.From)+len(e.To)+len(e.Cc)+len(e.Bcc))
 	i := 0
 
@@ -235,6 +240,7 @@ func (s *session) saveEmail(data []byte, inbox int64) error {
 			Relationship: ent.RelText,
 			Content:      []byte(e.TextBody),
 			MimeType:     "text/plain",
+			Charset:      e.TextCharset,
 			Size:         len(e.TextBody),
 		})
 	}
@@ -244,18 +250,31 @@ func (s *session) saveEmail(data []byte, inbox int64) error {
 			Relationship: ent.RelHTML,
 			Content:      []byte(e.HTMLBody),
 			MimeType:     "text/html",
+			Charset:      e.HTMLCharset,
 			Size:         len(e.HTMLBody),
 		})
+
+		if len(e.TextBody) == 0 {
+			if text := parsemail.HTMLToText(e.HTMLBody); text != "" {
+				content = append(content, ent.EmailContent{
+					Relationship: ent.RelHTMLText,
+					Content:      []byte(text),
+					MimeType:     "text/plain",
+					Size:         len(text),
+				})
+			}
+		}
 	}
 
 	for _, a := range e.Attachments {
 		if data, err := io.ReadAll(a.Data); err == nil {
-			filename := strings.Split(a.Filename, "/")
 			content = append(content, ent.EmailContent{
 				Relationship: ent.RelAttach,
 				Content:      data,
 				MimeType:     a.ContentType,
-				FileName:     filename[len(filename)-1],
+				Charset:      a.Charset,
+				ContentId:    a.CID,
+				FileName:     a.Filename,
 				Size:         len(data),
 			})
 		} else {
@@ -269,6 +288,8 @@ func (s *session) saveEmail(data []byte, inbox int64) error {
 				Relationship: ent.RelEmbedded,
 				Content:      data,
 				MimeType:     a.ContentType,
+				Charset:      a.Charset,
+				ContentId:    a.CID,
 				FileName:     "",
 				Size:         len(data),
 			})
@@ -282,19 +303,159 @@ func (s *session) saveEmail(data []byte, inbox int64) error {
 		h = []byte("{}")
 	}
 
+	events := make([]ent.CalendarEvent, len(e.CalendarEvents))
+	for i, ev := range e.CalendarEvents {
+		events[i] = buildCalendarEvent(&ev)
+	}
+
 	email := ent.Email{
-		InboxId:     inbox,
-		ClientIP:    s.conn.RemoteAddr().String(),
-		IsRead:      false,
-		ParseError:  err != nil,
-		MailFrom:    s.mailFrom,
-		Subject:     e.Subject,
-		HeadersJson: h,
-		Addresses:   addr,
-		Contents:    content,
-	}
-
-	return s.db.Create(&email).Error
+		InboxId:        inbox,
+		ClientIP:       s.conn.RemoteAddr().String(),
+		IsRead:         false,
+		ParseError:     parseErr != nil,
+		MailFrom:       s.mailFrom,
+		Subject:        e.Subject,
+		HeadersJson:    h,
+		Addresses:      addr,
+		Contents:       content,
+		CalendarEvents: events,
+	}
+
+	if e.Security != nil {
+		email.Security = e.Security.Protocol
+		email.Signature = e.Security.Signature
+		email.Signer = e.Security.Signer
+		email.Encryption = e.Security.Encryption
+		email.SecurityError = e.Security.Error
+	}
+
+	return email
+}
+
+func buildCalendarEvent(ev *parsemail.CalendarEvent) ent.CalendarEvent {
+	attendees := make([]ent.CalendarAttendee, len(ev.Attendees))
+	for i, a := range ev.Attendees {
+		attendees[i] = ent.CalendarAttendee{
+			Email:    a.Email,
+			Name:     a.Name,
+			Role:     a.Role,
+			PartStat: a.PartStat,
+			RSVP:     a.RSVP,
+		}
+	}
+
+	a, err := json.Marshal(attendees)
+	if err != nil {
+		a = []byte("[]")
+	}
+
+	event := ent.CalendarEvent{
+		Method:        ev.Method,
+		Uid:           ev.UID,
+		Sequence:      ev.Sequence,
+		RecurrenceId:  ev.RecurrenceID,
+		Summary:       ev.Summary,
+		Description:   ev.Description,
+		Location:      ev.Location,
+		Status:        ev.Status,
+		AttendeesJson: a,
+		AllDay:        ev.AllDay,
+		TimeZone:      ev.TimeZone,
+		RRule:         ev.RRule,
+	}
+
+	if ev.Organizer != nil {
+		event.OrganizerEmail = ev.Organizer.Email
+		event.OrganizerName = ev.Organizer.Name
+	}
+
+	if !ev.Start.IsZero() {
+		event.StartsAt = &ev.Start
+	}
+
+	if !ev.End.IsZero() {
+		event.EndsAt = &ev.End
+	}
+
+	return event
+}
+
+// loadKeyring returns the keys of an inbox, or nil if it has none. Keys that
+// can't be loaded are skipped.
+func (s *session) loadKeyring(inbox int64) *parsemail.Keyring {
+	var keys []ent.InboxKey
+	if err := s.db.Where("inbox_id = ?", inbox).Find(&keys).Error; err != nil {
+		log.Printf("failed to get keys for inbox %d: %s", inbox, err)
+		return nil
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	keyring := parsemail.NewKeyring()
+	for _, key := range keys {
+		if _, err := keyring.Add(key.Data); err != nil {
+			log.Printf("failed to load key %d for inbox %d: %s", key.Id, inbox, err)
+		}
+	}
+
+	return keyring
+}
+
+// createEmail saves a parsed email, followed by the messages embedded in it
+// with their parent_id set to it.
+func (s *session) createEmail(tx *gorm.DB, e *parsemail.Email, data []byte, inbox int64, parentId *int64, parseErr error) (ent.Email, error) {
+	email := s.buildEmail(e, data, inbox, parseErr)
+	email.ParentId = parentId
+	if err := tx.Create(&email).Error; err != nil {
+		return email, err
+	}
+
+	for _, m := range e.EmbeddedMessages {
+		if _, err := s.createEmail(tx, &m.Email, m.Data, inbox, &email.Id, m.Err); err != nil {
+			return email, err
+		}
+	}
+
+	return email, nil
+}
+
+func (s *session) saveEmail(data []byte, inbox int64) error {
+	e, parseErr := parsemail.ParseWithKeys(bytes.NewReader(data), s.loadKeyring(inbox))
+	if parseErr != nil {
+		log.Printf("failed to parse email from %s: %s", s.conn.RemoteAddr().String(), parseErr)
+	}
+
+	var email ent.Email
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		email, err = s.createEmail(tx, &e, data, inbox, nil, parseErr)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if s.index != nil {
+		if err := s.index.Add(&email); err != nil {
+			log.Printf("failed to index email %d: %s", email.Id, err)
+		}
+	}
+
+	if s.relay != nil {
+		go s.relay.AutoForward(s.db, &email)
+	}
+
+	if s.webhooks != nil {
+		go s.webhooks.Dispatch(&email)
+	}
+
+	if s.hub != nil {
+		s.hub.Publish(hub.Event{Type: hub.MessageCreated, InboxId: inbox, EmailId: email.Id})
+	}
+
+	return nil
 }
 
 func (s *session) handleData() error {
@@ -452,6 +613,10 @@ func (s *session) handleAuth(args string) error {
 
 	var inbox ent.Inbox
 	err := s.db.Where("name = ?", user).First(&inbox).Error
+	if err == nil && inbox.Expired() {
+		err = gorm.ErrRecordNotFound
+	}
+
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			log.Printf("failed auth from %s: user %s not found", ip, user)
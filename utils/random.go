@@ -3,6 +3,7 @@ package utils
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
 )
 
 func RandomString(n int) (string, error) {
@@ -14,3 +15,14 @@ func RandomString(n int) (string, error) {
 
 	return base64.RawURLEncoding.EncodeToString(b), nil
 }
+
+// RandomName returns a prefix followed by n random lowercase hex characters,
+// which can be used as the name of a temporary inbox.
+func RandomName(prefix string, n int) (string, error) {
+	b := make([]byte, (n+1)/2)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return prefix + hex.EncodeToString(b)[:n], nil
+}
@@ -1,9 +1,14 @@
 package utils
 
 import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/base64"
 	"errors"
+	"fmt"
+	"strconv"
 	"strings"
 	"sync"
 
@@ -48,3 +53,61 @@ func VerifySecret(input string, hash string) (bool, error) {
 
 	return subtle.ConstantTimeCompare(h.Sum(nil), d) == 1, nil
 }
+
+const (
+	ALGO_PBKDF2 = "$pbkdf2-sha256$"
+
+	pbkdf2Iterations = 600000
+	pbkdf2SaltLength = 16
+	pbkdf2KeyLength  = 32
+)
+
+// HashPassword hashes a password with PBKDF2-SHA256. Unlike HashSecret, it is
+// slow and salted, since passwords are chosen by users and may be guessable.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, pbkdf2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key, err := pbkdf2.Key(sha256.New, password, salt, pbkdf2Iterations, pbkdf2KeyLength)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s%d$%s$%s", ALGO_PBKDF2, pbkdf2Iterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func VerifyPassword(password string, hash string) (bool, error) {
+	if !strings.HasPrefix(hash, ALGO_PBKDF2) {
+		return false, ErrInvalidSecretAlg
+	}
+
+	parts := strings.Split(hash[len(ALGO_PBKDF2):], "$")
+	if len(parts) != 3 {
+		return false, ErrInvalidSecretAlg
+	}
+
+	iter, err := strconv.Atoi(parts[0])
+	if err != nil || iter <= 0 {
+		return false, ErrInvalidSecretAlg
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false, err
+	}
+
+	want, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false, err
+	}
+
+	key, err := pbkdf2.Key(sha256.New, password, salt, iter, len(want))
+	if err != nil {
+		return false, err
+	}
+
+	return subtle.ConstantTimeCompare(key, want) == 1, nil
+}
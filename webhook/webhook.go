@@ -0,0 +1,143 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	ent "github.com/supriyo-biswas/postbox/entities"
+	"gorm.io/gorm"
+)
+
+const (
+	maxAttempts    = 5
+	initialBackoff = time.Second
+	requestTimeout = 10 * time.Second
+
+	MessageCreated = "message_created"
+)
+
+// PayloadFunc returns the representation of an email that is sent to
+// webhooks.
+type PayloadFunc func(email *ent.Email) (any, error)
+
+type Dispatcher struct {
+	db      *gorm.DB
+	client  *http.Client
+	payload PayloadFunc
+}
+
+func NewDispatcher(db *gorm.DB, payload PayloadFunc) *Dispatcher {
+	return &Dispatcher{
+		db:      db,
+		client:  &http.Client{Timeout: requestTimeout},
+		payload: payload,
+	}
+}
+
+// Sign returns the value of the signature header for a request body.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Dispatch sends an email to every webhook of its inbox. Deliveries are made
+// in the background, and are retried with exponential backoff until they
+// succeed or run out of attempts.
+func (d *Dispatcher) Dispatch(email *ent.Email) {
+	var hooks []ent.Webhook
+	if err := d.db.Where("inbox_id = ?", email.InboxId).Find(&hooks).Error; err != nil {
+		log.Printf("failed to get webhooks for inbox %d: %s", email.InboxId, err)
+		return
+	}
+
+	if len(hooks) == 0 {
+		return
+	}
+
+	payload, err := d.payload(email)
+	if err != nil {
+		log.Printf("failed to build webhook payload for email %d: %s", email.Id, err)
+		return
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("failed to marshal webhook payload for email %d: %s", email.Id, err)
+		return
+	}
+
+	for _, hook := range hooks {
+		go d.deliver(hook, email.Id, body)
+	}
+}
+
+func (d *Dispatcher) deliver(hook ent.Webhook, emailId int64, body []byte) {
+	backoff := initialBackoff
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		delivery := ent.WebhookDelivery{
+			WebhookId: hook.Id,
+			EmailId:   emailId,
+			Attempt:   attempt,
+			Status:    ent.DeliverySent,
+		}
+
+		code, err := d.post(&hook, body)
+		delivery.StatusCode = code
+		if err != nil {
+			delivery.Status = ent.DeliveryFailed
+			delivery.Error = err.Error()
+		}
+
+		if err := d.db.Create(&delivery).Error; err != nil {
+			// the webhook may have been deleted in the meantime
+			log.Printf("failed to record delivery to webhook %d: %s", hook.Id, err)
+			return
+		}
+
+		if delivery.Status == ent.DeliverySent {
+			return
+		}
+
+		log.Printf("failed to deliver email %d to webhook %d: %s", emailId, hook.Id, delivery.Error)
+		if attempt < maxAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+// post sends a request to a webhook, and returns the status code of the
+// response, or zero if there wasn't one. Responses other than 2xx are errors.
+func (d *Dispatcher) post(hook *ent.Webhook, body []byte) (int, error) {
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "postbox")
+	req.Header.Set("X-Postbox-Event", MessageCreated)
+	req.Header.Set("X-Postbox-Signature", Sign(hook.Secret, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return resp.StatusCode, nil
+}